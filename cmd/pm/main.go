@@ -2,53 +2,164 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/alew-moose/pm/internal/downloader"
+	"github.com/alew-moose/pm/internal/httprepo"
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/remover"
+	"github.com/alew-moose/pm/internal/repository"
+	"github.com/alew-moose/pm/internal/s3repo"
 	"github.com/alew-moose/pm/internal/sftp"
+	"github.com/alew-moose/pm/internal/signature"
 	"github.com/alew-moose/pm/internal/uploader"
 )
 
+type options struct {
+	locked  bool
+	prefix  string
+	signKey string
+	force   bool
+}
+
 func main() {
 	log.SetFlags(0)
 
-	if len(os.Args) != 3 {
+	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	cmd, cmdConfigFile := os.Args[1], os.Args[2]
-	if cmd != "create" && cmd != "update" {
+	cmd := os.Args[1]
+	if cmd != "create" && cmd != "update" && cmd != "sign" && cmd != "remove" && cmd != "reindex" {
+		printUsage()
+		os.Exit(1)
+	}
+
+	var opts options
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flags.Usage = printUsage
+	switch cmd {
+	case "create":
+		flags.StringVar(&opts.signKey, "sign", "", "sign the package with the key")
+	case "update":
+		flags.BoolVar(&opts.locked, "locked", false, "install exactly the packages from pm.lock")
+		flags.StringVar(&opts.prefix, "prefix", "", "install packages into the directory")
+	case "sign":
+		flags.StringVar(&opts.signKey, "key", "", "sign packages with the key")
+	case "remove":
+		flags.BoolVar(&opts.force, "force", false, "remove packages other packages depend on and modified files")
+		flags.StringVar(&opts.prefix, "prefix", "", "remove packages from the directory")
+	}
+	_ = flags.Parse(os.Args[2:])
+	var argsOk bool
+	switch cmd {
+	case "sign":
+		argsOk = flags.NArg() > 0 && opts.signKey != ""
+	case "remove":
+		argsOk = flags.NArg() > 0
+	case "reindex":
+		argsOk = flags.NArg() == 0
+	default:
+		argsOk = flags.NArg() == 1
+	}
+	if !argsOk {
 		printUsage()
 		os.Exit(1)
 	}
 
-	sftpClient, err := newSftpClient()
+	// removing packages is local and doesn't need the repository
+	if cmd == "remove" {
+		if err := remove(flags.Args(), opts); err != nil {
+			log.Fatalf("failed to remove: %s", err)
+		}
+		return
+	}
+
+	configFile, err := pmConfigFile()
+	if err != nil {
+		log.Fatalf("failed to find config: %s", err)
+	}
+
+	// packages may be installed from a read-only mirror
+	repo, err := newRepository(configFile, cmd == "update")
 	if err != nil {
-		log.Fatalf("failed to create sftp client: %s", err)
+		log.Fatalf("failed to open repository: %s", err)
 	}
 
 	switch cmd {
 	case "create":
-		if err := upload(sftpClient, cmdConfigFile); err != nil {
+		if err := upload(repo, configFile, flags.Arg(0), opts); err != nil {
 			log.Fatalf("failed to upload: %s", err)
 		}
 	case "update":
-		if err := download(sftpClient, cmdConfigFile); err != nil {
+		if err := download(repo, configFile, flags.Arg(0), opts); err != nil {
 			log.Fatalf("failed to download: %s", err)
 		}
+	case "sign":
+		if err := sign(repo, flags.Args(), opts); err != nil {
+			log.Fatalf("failed to sign: %s", err)
+		}
+	case "reindex":
+		if err := uploader.Reindex(repo); err != nil {
+			log.Fatalf("failed to reindex: %s", err)
+		}
+		log.Println("Index successfully rebuilt")
 	}
 }
 
-func newSftpClient() (*sftp.Client, error) {
+func pmConfigFile() (string, error) {
 	home := os.Getenv("HOME")
 	if home == "" {
-		return nil, errors.New("HOME is empty")
+		return "", errors.New("HOME is empty")
+	}
+	return fmt.Sprintf("%s/.pm.json", home), nil
+}
+
+// newRepository returns the repository from the config, the one to install
+// packages from if read is true. It doesn't connect until the repository
+// is used.
+func newRepository(configFile string, read bool) (repository.Repository, error) {
+	repoConfig, err := repository.ConfigFromFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %s", err)
+	}
+	rawURL := repoConfig.URL
+	if read && repoConfig.ReadURL != "" {
+		rawURL = repoConfig.ReadURL
+	}
+	if rawURL == "" {
+		return newSftpClient(configFile)
 	}
-	configFile := fmt.Sprintf("%s/.pm.json", home)
 
+	u, err := repository.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository: %s", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return repository.NewDir(filepath.FromSlash(u.Path)), nil
+	case "http", "https":
+		httpConfig, err := httprepo.ConfigFromFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("load config: %s", err)
+		}
+		return httprepo.NewClient(u, httpConfig)
+	case "s3":
+		s3Config, err := s3repo.ConfigFromFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("load config: %s", err)
+		}
+		return s3repo.NewClient(u, s3Config)
+	}
+	return nil, fmt.Errorf("unsupported repository %q", u.Redacted())
+}
+
+func newSftpClient(configFile string) (*sftp.Client, error) {
 	sftpConfig, err := sftp.ConfigFromFile(configFile)
 	if err != nil {
 		return nil, fmt.Errorf("load config: %s", err)
@@ -62,13 +173,31 @@ func newSftpClient() (*sftp.Client, error) {
 	return sftpClient, nil
 }
 
-func upload(sftpClient *sftp.Client, cmdConfigFile string) error {
+func newKeyring(configFile string) (*signature.Keyring, error) {
+	signatureConfig, err := signature.ConfigFromFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %s", err)
+	}
+	return signature.NewKeyring(signatureConfig)
+}
+
+func upload(repo repository.Repository, configFile, cmdConfigFile string, opts options) error {
 	config, err := uploader.ConfigFromFile(cmdConfigFile)
 	if err != nil {
 		return fmt.Errorf("parse uploader config: %s", err)
 	}
+	if opts.signKey != "" {
+		config.Signer, err = signature.NewSigner(opts.signKey)
+		if err != nil {
+			return fmt.Errorf("load signing key: %s", err)
+		}
+	}
+	config.Keyring, err = newKeyring(configFile)
+	if err != nil {
+		return fmt.Errorf("load trusted keys: %s", err)
+	}
 
-	uploader, err := uploader.NewPackageUploader(config, sftpClient)
+	uploader, err := uploader.NewPackageUploader(config, repo)
 	if err != nil {
 		return fmt.Errorf("create new uploader: %s", err)
 	}
@@ -82,13 +211,21 @@ func upload(sftpClient *sftp.Client, cmdConfigFile string) error {
 	return nil
 }
 
-func download(sftpClient *sftp.Client, cmdConfigFile string) error {
+func download(repo repository.Repository, configFile, cmdConfigFile string, opts options) error {
 	config, err := downloader.ConfigFromFile(cmdConfigFile)
 	if err != nil {
 		return fmt.Errorf("parse downloader config: %s", err)
 	}
+	config.Locked = opts.locked
+	if opts.prefix != "" {
+		config.Prefix = opts.prefix
+	}
+	config.Keyring, err = newKeyring(configFile)
+	if err != nil {
+		return fmt.Errorf("load trusted keys: %s", err)
+	}
 
-	downloader, err := downloader.NewPackageDownloader(config, sftpClient)
+	downloader, err := downloader.NewPackageDownloader(config, repo)
 	if err != nil {
 		return fmt.Errorf("create new downloader: %s", err)
 	}
@@ -102,11 +239,68 @@ func download(sftpClient *sftp.Client, cmdConfigFile string) error {
 	return nil
 }
 
+func sign(repo repository.Repository, packageNames []string, opts options) error {
+	signer, err := signature.NewSigner(opts.signKey)
+	if err != nil {
+		return fmt.Errorf("load signing key: %s", err)
+	}
+
+	for _, packageName := range packageNames {
+		pv, err := pkg.PackageVersionFromString(packageName)
+		if err != nil {
+			return err
+		}
+		if err := uploader.SignPackage(repo, signer, pv); err != nil {
+			return fmt.Errorf("sign %s: %s", pv, err)
+		}
+	}
+
+	log.Println("Packages successfully signed")
+
+	return nil
+}
+
+func remove(packageNames []string, opts options) error {
+	config := &remover.Config{
+		Prefix: opts.prefix,
+		Force:  opts.force,
+	}
+	for _, packageName := range packageNames {
+		config.Packages = append(config.Packages, pkg.PackageName(packageName))
+	}
+
+	remover, err := remover.NewPackageRemover(config)
+	if err != nil {
+		return fmt.Errorf("create new remover: %s", err)
+	}
+
+	if err := remover.Remove(); err != nil {
+		return fmt.Errorf("remove: %s", err)
+	}
+
+	log.Println("Packages successfully removed")
+
+	return nil
+}
+
 func printUsage() {
 	usageStr := fmt.Sprintf(
 		"Usage:\n"+
-			"\t%[1]s create <create-config-file.json | create-config-file.yaml>\n"+
-			"\t%[1]s update <update-config-file.json | update-config-file.yaml>\n",
+			"\t%[1]s create [--sign <key>] <create-config-file.json | create-config-file.yaml>\n"+
+			"\t%[1]s update [--locked] [--prefix <dir>] <update-config-file.json | update-config-file.yaml>\n"+
+			"\t%[1]s sign --key <key> <name-version>...\n"+
+			"\t%[1]s remove [--force] [--prefix <dir>] <name>...\n"+
+			"\t%[1]s reindex\n"+
+			"\n"+
+			"Options:\n"+
+			"\t--locked       install exactly the packages recorded in pm.lock next to the update config\n"+
+			"\t--prefix <dir> install root, overrides \"prefix\" of the update config;\n"+
+			"\t               the current directory by default\n"+
+			"\t--sign <key>   sign the package; key is a private key file, a public key file\n"+
+			"\t               of a key in ssh-agent or agent:<SHA256 fingerprint>\n"+
+			"\t--key <key>    add a signature to already published packages, e.g. after key rotation\n"+
+			"\t--force        remove packages other installed packages depend on and files\n"+
+			"\t               modified after installation\n",
 		os.Args[0],
 	)
 	fmt.Fprintln(os.Stderr, usageStr)
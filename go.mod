@@ -3,7 +3,9 @@ module github.com/alew-moose/pm
 go 1.25.3
 
 require (
+	github.com/klauspost/compress v1.20.1
 	github.com/pkg/sftp v1.13.10
+	github.com/ulikunitz/xz v0.5.17
 	golang.org/x/crypto v0.43.0
 	gopkg.in/yaml.v3 v3.0.1
 )
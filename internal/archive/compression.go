@@ -0,0 +1,109 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the compression format of package archives.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	CompressionXz   Compression = "xz"
+	CompressionNone Compression = "none"
+)
+
+// DefaultCompression is used if the package config doesn't set one.
+const DefaultCompression = CompressionGzip
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+func (c Compression) Validate() error {
+	switch c {
+	case CompressionGzip, CompressionZstd, CompressionXz, CompressionNone:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, supported: gzip, zstd, xz, none", c)
+}
+
+// Ext returns the file name extension of archives, e.g. ".tar.gz".
+func (c Compression) Ext() string {
+	switch c {
+	case CompressionGzip:
+		return ".tar.gz"
+	case CompressionZstd:
+		return ".tar.zst"
+	case CompressionXz:
+		return ".tar.xz"
+	}
+	return ".tar"
+}
+
+// NewWriter returns a writer compressing into w. Closing it doesn't close w.
+// Compression settings are fixed, so the same data is always compressed to
+// the same bytes, and the gzip header has no name and timestamp.
+func NewWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	case CompressionXz:
+		return xz.WriterConfig{}.NewWriter(w)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// NewReader returns a reader decompressing r. The compression is detected
+// by the magic bytes, data without a known magic is read as is.
+func NewReader(r io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", fmt.Errorf("gzip: %s", err)
+		}
+		return gzr, CompressionGzip, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, "", fmt.Errorf("zstd: %s", err)
+		}
+		return zr.IOReadCloser(), CompressionZstd, nil
+	case bytes.HasPrefix(magic, xzMagic):
+		xzr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, "", fmt.Errorf("xz: %s", err)
+		}
+		return io.NopCloser(xzr), CompressionXz, nil
+	}
+	return io.NopCloser(br), CompressionNone, nil
+}
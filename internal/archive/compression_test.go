@@ -0,0 +1,54 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("package contents "), 1000)
+
+	tests := []Compression{CompressionGzip, CompressionZstd, CompressionXz, CompressionNone}
+	for ti, compression := range tests {
+		if err := compression.Validate(); err != nil {
+			t.Errorf("failed test #%d: %s: Validate returned error %q", ti, compression, err)
+			continue
+		}
+
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, compression)
+		if err != nil {
+			t.Errorf("failed test #%d: %s: NewWriter returned error %q", ti, compression, err)
+			continue
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, detected, err := NewReader(&buf)
+		if err != nil {
+			t.Errorf("failed test #%d: %s: NewReader returned error %q", ti, compression, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Errorf("failed test #%d: %s: read returned error %q", ti, compression, err)
+			continue
+		}
+		if detected != compression {
+			t.Errorf("failed test #%d: detected %s, want %s", ti, detected, compression)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("failed test #%d: %s: decompressed data differs", ti, compression)
+		}
+	}
+
+	if err := Compression("bzip2").Validate(); err == nil {
+		t.Errorf("Validate of unknown compression returned no error")
+	}
+}
@@ -0,0 +1,152 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+// Dir holds pm's own entries in archives. Entries in it are never
+// extracted.
+const Dir = ".pm"
+
+// ManifestPath is the name of the manifest entry. It is always the first
+// entry of an archive.
+const ManifestPath = Dir + "/manifest.json"
+
+// ErrNoManifest is returned for archives created before manifests were
+// introduced.
+var ErrNoManifest = errors.New("archive has no manifest")
+
+// Manifest describes a package archive and every file in it.
+type Manifest struct {
+	pkg.Metadata
+	Targets   json.RawMessage `json:"targets,omitempty"`
+	BuildTime time.Time       `json:"build_time"`
+	Files     []File          `json:"files"`
+}
+
+// File is an archive entry. Mode has type bits of directories and
+// symbolic links. Link is the target of a symbolic link, or the path of
+// the earlier entry a regular file is a hard link to. Size and SHA256 are
+// only set for regular files.
+type File struct {
+	Path    string      `json:"path"`
+	Mode    fs.FileMode `json:"mode"`
+	Link    string      `json:"link,omitempty"`
+	ModTime time.Time   `json:"mtime,omitzero"`
+	Size    int64       `json:"size,omitempty"`
+	SHA256  string      `json:"sha256,omitempty"`
+}
+
+// FilesByPath returns the manifest entries keyed by their cleaned paths.
+// The first entry is kept if paths repeat.
+func (m *Manifest) FilesByPath() map[string]File {
+	files := make(map[string]File, len(m.Files))
+	for _, f := range m.Files {
+		name := path.Clean(f.Path)
+		if _, ok := files[name]; !ok {
+			files[name] = f
+		}
+	}
+	return files
+}
+
+// IsReserved reports whether the archive entry name belongs to pm.
+func IsReserved(name string) bool {
+	name = path.Clean(name)
+	return name == Dir || strings.HasPrefix(name, Dir+"/")
+}
+
+// CheckSymlink checks that the symbolic link entry name pointing to target
+// can't lead outside the install root: the target must be relative and
+// must not go above the root.
+func CheckSymlink(name, target string) error {
+	if target == "" {
+		return fmt.Errorf("symbolic link %q has no target", name)
+	}
+	if path.IsAbs(target) || !filepath.IsLocal(path.Join(path.Dir(path.Clean(name)), target)) {
+		return fmt.Errorf("symbolic link %q points outside the install root: %q", name, target)
+	}
+	return nil
+}
+
+// WriteManifest writes the manifest as the next entry of tw.
+func WriteManifest(tw *tar.Writer, manifest *Manifest) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return fmt.Errorf("marshal json: %s", err)
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ManifestPath,
+		Mode:     0644,
+		Size:     int64(buf.Len()),
+		ModTime:  manifest.BuildTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("write header: %s", err)
+	}
+	if _, err := tw.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+
+	return nil
+}
+
+// ReadManifest reads the manifest of the archive at archivePath without
+// reading the rest of the archive.
+func ReadManifest(archivePath string) (*Manifest, error) {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = archiveFile.Close()
+	}()
+
+	r, _, err := NewReader(archiveFile)
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %s", err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	tr := tar.NewReader(r)
+
+	header, err := tr.Next()
+	if err == io.EOF {
+		return nil, ErrNoManifest
+	}
+	if err != nil && err != tar.ErrInsecurePath {
+		return nil, fmt.Errorf("tar: %s", err)
+	}
+	if header.Name != ManifestPath {
+		return nil, ErrNoManifest
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest: %s", err)
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", err)
+	}
+
+	return &manifest, nil
+}
@@ -0,0 +1,119 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+func writeTestArchive(t *testing.T, manifest *Manifest, names ...string) string {
+	t.Helper()
+
+	archivePath := filepath.Join(t.TempDir(), "test.tar.gz")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	if manifest != nil {
+		if err := WriteManifest(tw, manifest); err != nil {
+			t.Fatalf("WriteManifest returned error %q", err)
+		}
+	}
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return archivePath
+}
+
+func TestReadManifest(t *testing.T) {
+	manifest := &Manifest{
+		Metadata: pkg.Metadata{
+			Name:    "packet",
+			Version: version.Version{Major: 1, Minor: 2},
+		},
+		BuildTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Files: []File{
+			{Path: "a.txt", Mode: 0644, Size: 0, SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		},
+	}
+	archivePath := writeTestArchive(t, manifest, "a.txt")
+
+	got, err := ReadManifest(archivePath)
+	if err != nil {
+		t.Fatalf("ReadManifest returned error %q", err)
+	}
+	if got.PackageVersion() != manifest.PackageVersion() || !got.BuildTime.Equal(manifest.BuildTime) {
+		t.Errorf("got manifest of %s built at %s, want %s built at %s", got.PackageVersion(), got.BuildTime, manifest.PackageVersion(), manifest.BuildTime)
+	}
+	if f, ok := got.FilesByPath()["a.txt"]; !ok || f != manifest.Files[0] {
+		t.Errorf("got file %#v, want %#v", f, manifest.Files[0])
+	}
+
+	archivePath = writeTestArchive(t, nil, "a.txt")
+	if _, err := ReadManifest(archivePath); !errors.Is(err, ErrNoManifest) {
+		t.Errorf("expected ErrNoManifest, got %v", err)
+	}
+}
+
+func TestIsReserved(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: ".pm", want: true},
+		{name: ".pm/manifest.json", want: true},
+		{name: "./.pm/manifest.json", want: true},
+		{name: ".pmrc", want: false},
+		{name: "dir/.pm/manifest.json", want: false},
+	}
+	for _, tt := range tests {
+		if got := IsReserved(tt.name); got != tt.want {
+			t.Errorf("IsReserved(%q): got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSymlink(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		wantErr bool
+	}{
+		{name: "lib/libx.so", target: "libx.so.1", wantErr: false},
+		{name: "bin/tool", target: "../libexec/tool", wantErr: false},
+		{name: "a/b/c", target: "../../d", wantErr: false},
+		{name: "a/b/c", target: "../../../d", wantErr: true},
+		{name: "bin/tool", target: "/usr/bin/tool", wantErr: true},
+		{name: "tool", target: "..", wantErr: true},
+		{name: "tool", target: "", wantErr: true},
+	}
+
+	for ti, tt := range tests {
+		err := CheckSymlink(tt.name, tt.target)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("failed test #%d: CheckSymlink(%q, %q): got error %v, want error %t", ti, tt.name, tt.target, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// FileSHA256 returns the hex encoded SHA-256 digest of the file at path.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	sum, err := SHA256(f)
+	if err != nil {
+		return "", fmt.Errorf("read %q: %s", path, err)
+	}
+
+	return sum, nil
+}
+
+// SHA256 returns the hex encoded SHA-256 digest of everything read from r.
+func SHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Format returns a line in sha256sum(1) format.
+func Format(sha256Hex, name string) string {
+	return fmt.Sprintf("%s  %s\n", sha256Hex, name)
+}
+
+var lineRe = regexp.MustCompile(`^([0-9a-f]{64}) [ *](.+)$`)
+
+// Parse parses a line in sha256sum(1) format and checks it is for name.
+func Parse(s, name string) (string, error) {
+	matches := lineRe.FindStringSubmatch(strings.TrimSpace(s))
+	if len(matches) == 0 {
+		return "", fmt.Errorf("invalid checksum %q", s)
+	}
+	if matches[2] != name {
+		return "", fmt.Errorf("checksum is for %q, not %q", matches[2], name)
+	}
+	return matches[1], nil
+}
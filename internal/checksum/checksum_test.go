@@ -0,0 +1,34 @@
+package checksum
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	const sum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	tests := []struct {
+		str     string
+		name    string
+		wantErr bool
+	}{
+		{str: Format(sum, "packet-1.0.0"), name: "packet-1.0.0"},
+		{str: sum + " *packet-1.0.0", name: "packet-1.0.0"},
+		{str: Format(sum, "packet-1.0.0"), name: "packet-2.0.0", wantErr: true},
+		{str: sum, name: "packet-1.0.0", wantErr: true},
+		{str: Format(sum[1:], "packet-1.0.0"), name: "packet-1.0.0", wantErr: true},
+		{str: "", name: "packet-1.0.0", wantErr: true},
+	}
+
+	for ti, tt := range tests {
+		got, err := Parse(tt.str, tt.name)
+		if err != nil && !tt.wantErr {
+			t.Errorf("failed test #%d: Parse(%q, %q) returned error %q", ti, tt.str, tt.name, err)
+			continue
+		}
+		if err == nil && tt.wantErr {
+			t.Errorf("failed test #%d: expected error from Parse(%q, %q)", ti, tt.str, tt.name)
+			continue
+		}
+		if !tt.wantErr && got != sum {
+			t.Errorf("failed test #%d: Parse(%q, %q): got %q, want %q", ti, tt.str, tt.name, got, sum)
+		}
+	}
+}
@@ -8,24 +8,38 @@ import (
 	"path/filepath"
 
 	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/signature"
 	"github.com/alew-moose/pm/internal/version"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	Packages []pkg.PackageVersionSpec `json:"packages" yaml:"packages"`
+	// Prefix is the install root, all files are extracted into it. A
+	// relative prefix in a config file is relative to the file's
+	// directory. The current directory is used if it is empty.
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+
+	// LockFile is where selected packages are recorded. Nothing is
+	// recorded if it is empty.
+	LockFile string `json:"-" yaml:"-"`
+	// Locked makes the downloader install exactly the packages from
+	// LockFile instead of resolving versions.
+	Locked bool `json:"-" yaml:"-"`
+	// Keyring verifies package signatures if it is not nil.
+	Keyring *signature.Keyring `json:"-" yaml:"-"`
 }
 
 func (c *Config) Validate() error {
-	packages := make(map[pkg.PackageVersionSpec]struct{}, len(c.Packages))
+	packages := make(map[string]struct{}, len(c.Packages))
 	for _, p := range c.Packages {
 		if err := p.Validate(); err != nil {
 			return err
 		}
-		if _, ok := packages[p]; ok {
+		if _, ok := packages[p.String()]; ok {
 			return fmt.Errorf("duplicate package %s", p)
 		}
-		packages[p] = struct{}{}
+		packages[p.String()] = struct{}{}
 	}
 	return nil
 }
@@ -55,6 +69,10 @@ func ConfigFromFile(path string) (*Config, error) {
 	}
 
 	FillDefaultVersionSpecs(config.Packages)
+	config.LockFile = filepath.Join(filepath.Dir(path), LockFileName)
+	if config.Prefix != "" && !filepath.IsAbs(config.Prefix) {
+		config.Prefix = filepath.Join(filepath.Dir(path), config.Prefix)
+	}
 
 	return config, nil
 }
@@ -75,19 +93,20 @@ func fromYAML(b []byte) (*Config, error) {
 	return &config, nil
 }
 
-var emptyVersionSpec = version.VersionSpec{}
-var defaultVersionSpec = version.VersionSpec{
-	Version: version.Version{
-		Major: 0,
-		Minor: 1,
+var defaultVersionSpec = version.VersionSpec{{
+	{
+		Version: version.Version{
+			Major: 0,
+			Minor: 1,
+		},
+		Comparison: version.ComparisonGreaterOrEqual,
 	},
-	Comparison: version.ComparisonGreaterOrEqual,
-}
+}}
 
 func FillDefaultVersionSpecs(packages []pkg.PackageVersionSpec) {
 	for i := range packages {
 		p := &packages[i]
-		if p.VersionSpec == emptyVersionSpec {
+		if len(p.VersionSpec) == 0 {
 			log.Printf("using default version spec %s for package %s\n", defaultVersionSpec, p.Name)
 			p.VersionSpec = defaultVersionSpec
 		}
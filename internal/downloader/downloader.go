@@ -2,172 +2,562 @@ package downloader
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/installed"
 	"github.com/alew-moose/pm/internal/pkg"
-	"github.com/alew-moose/pm/internal/sftp"
+	"github.com/alew-moose/pm/internal/remover"
+	"github.com/alew-moose/pm/internal/repository"
+	"github.com/alew-moose/pm/internal/signature"
+	"github.com/alew-moose/pm/internal/transaction"
 )
 
 type PackageDownloader struct {
-	config     *Config
-	sftpClient *sftp.Client
+	config *Config
+	repo   repository.Repository
+	// files are names of package archives in the repository
+	files map[pkg.PackageVersion]string
+	// indexed is the metadata of packages read from the repository index
+	indexed map[pkg.PackageVersion]*pkg.Metadata
 }
 
-func NewPackageDownloader(config *Config, sftpClient *sftp.Client) (*PackageDownloader, error) {
+func NewPackageDownloader(config *Config, repo repository.Repository) (*PackageDownloader, error) {
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid config: %s", err)
 	}
 	pd := &PackageDownloader{
-		config:     config,
-		sftpClient: sftpClient,
+		config: config,
+		repo:   repo,
 	}
 	return pd, nil
 }
 
 func (d *PackageDownloader) Download() error {
 	log.Printf("download packages: %s\n", stringersSliceToString(d.config.Packages))
-	packages, err := d.findPackages()
+
+	var packages []LockedPackage
+	if d.config.Locked {
+		lockFile, err := d.readLockFile()
+		if err != nil {
+			return err
+		}
+		packages = lockFile.Packages
+		d.files = make(map[pkg.PackageVersion]string, len(packages))
+		for _, p := range packages {
+			d.files[p.PackageVersion()] = p.FileName()
+		}
+	} else {
+		found, err := d.findPackages()
+		if err != nil {
+			return fmt.Errorf("find packages: %s", err)
+		}
+		for _, pv := range found {
+			p := LockedPackage{Name: pv.Name, Version: pv.Version}
+			if name := d.fileName(pv); name != pv.String() {
+				p.File = name
+			}
+			packages = append(packages, p)
+		}
+	}
+
+	root, err := d.openRoot()
+	if err != nil {
+		return fmt.Errorf("open install root: %s", err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	// the database may be restored by the recovery
+	if err := transaction.Recover(root); err != nil {
+		return fmt.Errorf("recover interrupted transaction: %s", err)
+	}
+	db, err := installed.Load(root)
 	if err != nil {
-		return fmt.Errorf("find packages: %s", err)
+		return fmt.Errorf("load installed packages: %s", err)
 	}
 
-	for _, p := range packages {
-		archivePath, err := d.sftpClient.DownloadPackage(p)
+	// every archive is downloaded and verified before anything is
+	// extracted
+	var downloads []download
+	defer func() {
+		for _, dl := range downloads {
+			if err := os.Remove(dl.archivePath); err != nil {
+				log.Printf("remove %q: %s\n", dl.archivePath, err)
+			}
+		}
+	}()
+	for i := range packages {
+		p := &packages[i]
+		if ip, ok := db.Package(p.Name); ok && ip.Version == p.Version && (!d.config.Locked || ip.SHA256 == p.SHA256) {
+			log.Printf("package %s is already installed\n", p.PackageVersion())
+			p.SHA256 = ip.SHA256
+			continue
+		}
+
+		archivePath, err := repository.DownloadPackage(d.repo, d.fileName(p.PackageVersion()))
 		if err != nil {
 			return fmt.Errorf("download package: %s", err)
 		}
+		downloads = append(downloads, download{pkg: p, archivePath: archivePath})
+
+		sum, err := d.verifyChecksum(p.PackageVersion(), archivePath)
+		if err != nil {
+			return err
+		}
+		if d.config.Locked && sum != p.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s: locked %s, downloaded %s", p.PackageVersion(), p.SHA256, sum)
+		}
+		p.SHA256 = sum
+
+		if err := d.verifySignature(p.PackageVersion(), sum); err != nil {
+			return err
+		}
+	}
 
-		log.Printf("extracting %s\n", archivePath)
-		if err := d.extractArchive(archivePath); err != nil {
-			return fmt.Errorf("extract archive: %s", err)
+	// conflicts are found from manifests before anything is staged, files
+	// of old archives are only known once they are extracted
+	exists := func(name string) bool {
+		_, err := root.Lstat(name)
+		return !errors.Is(err, os.ErrNotExist)
+	}
+	planned := make([]installed.Package, 0, len(downloads))
+	for _, dl := range downloads {
+		p, err := d.plannedPackage(dl)
+		if err != nil {
+			return fmt.Errorf("install %s: %s", dl.pkg.PackageVersion(), err)
+		}
+		if p != nil {
+			planned = append(planned, *p)
+		}
+	}
+	if conflicts := db.Conflicts(planned, exists); len(conflicts) > 0 {
+		return &installed.ConflictError{Conflicts: conflicts}
+	}
+
+	// all packages are installed at once, or none of them
+	txn, err := transaction.Begin(root)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %s", err)
+	}
+	defer func() {
+		_ = txn.Rollback()
+	}()
+	staged := make([]installed.Package, 0, len(downloads))
+	for _, dl := range downloads {
+		p, err := d.stage(txn, dl)
+		if err != nil {
+			return fmt.Errorf("install %s: %s", dl.pkg.PackageVersion(), err)
+		}
+		staged = append(staged, *p)
+	}
+	if len(planned) < len(staged) {
+		if conflicts := db.Conflicts(staged, exists); len(conflicts) > 0 {
+			return &installed.ConflictError{Conflicts: conflicts}
+		}
+	}
+	if err := upgrade(root, txn, db, staged); err != nil {
+		return err
+	}
+	b, err := db.JSON()
+	if err != nil {
+		return fmt.Errorf("save installed packages: %s", err)
+	}
+	if err := txn.WriteFile(installed.DBPath, b, 0644); err != nil {
+		return fmt.Errorf("save installed packages: %s", err)
+	}
+	log.Printf("installing files into %q\n", root.Name())
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("commit: %s", err)
+	}
+
+	if !d.config.Locked && d.config.LockFile != "" {
+		lockFile := &LockFile{
+			Requested: d.config.Packages,
+			Packages:  packages,
+		}
+		log.Printf("writing lock file %q\n", d.config.LockFile)
+		if err := lockFile.WriteFile(d.config.LockFile); err != nil {
+			return fmt.Errorf("write lock file: %s", err)
 		}
 	}
 
 	return nil
 }
 
-func (d *PackageDownloader) findPackages() ([]string, error) {
-	files, err := d.sftpClient.GetPackages()
+// verifyChecksum compares the digest of the downloaded archive with the
+// one published next to the package and returns it.
+func (d *PackageDownloader) verifyChecksum(pv pkg.PackageVersion, archivePath string) (string, error) {
+	sum, err := checksum.FileSHA256(archivePath)
 	if err != nil {
-		return nil, fmt.Errorf("get packages: %s", err)
+		return "", fmt.Errorf("checksum: %s", err)
 	}
 
-	found := make(map[pkg.PackageVersionSpec]pkg.PackageVersion)
-	for _, file := range files {
-		pv, err := pkg.PackageVersionFromString(file.Name())
+	publishedSum, err := repository.DownloadPackageChecksum(d.repo, d.fileName(pv))
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("package %s has no published checksum, can't verify it\n", pv)
+		return sum, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("download checksum of %s: %s", pv, err)
+	}
+
+	if sum != publishedSum {
+		return "", fmt.Errorf("checksum mismatch for %s: published %s, downloaded %s", pv, publishedSum, sum)
+	}
+	log.Printf("package %s checksum verified: %s\n", pv, sum)
+
+	return sum, nil
+}
+
+// verifySignature checks the package is signed by a trusted key, unless
+// no trusted keys are configured.
+func (d *PackageDownloader) verifySignature(pv pkg.PackageVersion, sum string) error {
+	if d.config.Keyring == nil {
+		return nil
+	}
+
+	var sigs *signature.Signatures
+	b, err := repository.DownloadPackageSignatures(d.repo, d.fileName(pv))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("download signatures of %s: %s", pv, err)
+	}
+	if err == nil {
+		sigs, err = signature.SignaturesFromJSON(b)
 		if err != nil {
-			log.Printf("invalid package name %q: %s, skipping\n", file.Name(), err)
-			continue
+			return fmt.Errorf("parse signatures of %s: %s", pv, err)
 		}
-		for _, pvs := range d.config.Packages {
-			if !pvs.Match(pv) {
-				continue
-			}
-			if foundPV, ok := found[pvs]; !ok || pv.Version.GreaterThan(foundPV.Version) {
-				log.Printf("found package for %s: %s\n", pvs, pv)
-				found[pvs] = pv
-			}
+	}
+
+	key, err := d.config.Keyring.Verify(d.fileName(pv), sum, sigs)
+	if err != nil {
+		return err
+	}
+	log.Printf("package %s is signed by %s\n", pv, key)
+
+	return nil
+}
+
+func (d *PackageDownloader) readLockFile() (*LockFile, error) {
+	if d.config.LockFile == "" {
+		return nil, errors.New("no lock file")
+	}
+	log.Printf("reading lock file %q\n", d.config.LockFile)
+	lockFile, err := LockFileFromFile(d.config.LockFile)
+	if err != nil {
+		return nil, fmt.Errorf("read lock file: %s", err)
+	}
+	if err := lockFile.CheckFresh(d.config.Packages); err != nil {
+		return nil, err
+	}
+	return lockFile, nil
+}
+
+// download is a downloaded and verified package archive.
+type download struct {
+	pkg         *LockedPackage
+	archivePath string
+}
+
+// plannedPackage returns the package with the files listed in the
+// manifest of its archive, or nil if the archive has no manifest.
+func (d *PackageDownloader) plannedPackage(dl download) (*installed.Package, error) {
+	manifest, err := archive.ReadManifest(dl.archivePath)
+	if errors.Is(err, archive.ErrNoManifest) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %s", err)
+	}
+
+	metadata, err := d.installedMetadata(dl.pkg.PackageVersion(), manifest)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]archive.File, 0, len(manifest.Files))
+	for _, f := range manifest.Files {
+		if !filepath.IsLocal(f.Path) {
+			return nil, fmt.Errorf("%q is outside the install root", f.Path)
 		}
+		f.Path = path.Clean(f.Path)
+		files = append(files, f)
 	}
 
-	var notFound []pkg.PackageVersionSpec
-	foundPackages := make(map[pkg.PackageVersion][]pkg.PackageVersionSpec, len(found))
-	packages := make([]string, 0, len(foundPackages))
-	for _, pvs := range d.config.Packages {
-		if pv, ok := found[pvs]; ok {
-			if len(foundPackages[pv]) == 0 {
-				packages = append(packages, pv.String())
-			}
-			foundPackages[pv] = append(foundPackages[pv], pvs)
-		} else {
-			notFound = append(notFound, pvs)
+	return &installed.Package{Metadata: *metadata, Files: files}, nil
+}
+
+// stage extracts files of the archive into the transaction and returns
+// the package to be recorded in the database.
+func (d *PackageDownloader) stage(txn *transaction.Transaction, dl download) (*installed.Package, error) {
+	log.Printf("extracting %s\n", dl.archivePath)
+	manifest, files, err := extractArchive(txn, dl.archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("extract archive: %s", err)
+	}
+
+	metadata, err := d.installedMetadata(dl.pkg.PackageVersion(), manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &installed.Package{
+		Metadata:    *metadata,
+		SHA256:      dl.pkg.SHA256,
+		InstallTime: time.Now().UTC().Truncate(time.Second),
+		Files:       files,
+	}, nil
+}
+
+// upgrade records the staged packages in the database and removes files
+// of their previous versions that are not in the new ones.
+func upgrade(root *os.Root, txn *transaction.Transaction, db *installed.DB, staged []installed.Package) error {
+	previous := make(map[pkg.PackageName]installed.Package)
+	for _, p := range staged {
+		if ip, ok := db.Package(p.Name); ok {
+			log.Printf("upgrading %s to %s\n", ip.PackageVersion(), p.PackageVersion())
+			previous[p.Name] = *ip
 		}
 	}
 
-	if len(notFound) > 0 {
-		return nil, fmt.Errorf("packages not found: %s", stringersSliceToString(notFound))
+	// all packages are recorded first, so that files moved between them
+	// are not removed
+	for _, p := range staged {
+		db.Add(p)
 	}
 
-	for pv, pvss := range foundPackages {
-		if len(pvss) > 1 {
-			log.Printf("package %s satisfies several specs (%s), but will be downloaded and extracted only once\n", pv, stringersSliceToString(pvss))
+	for _, p := range staged {
+		prev, ok := previous[p.Name]
+		if !ok {
+			continue
+		}
+		paths := make(map[string]struct{}, len(p.Files))
+		for _, f := range p.Files {
+			paths[f.Path] = struct{}{}
+		}
+		var obsolete []archive.File
+		for _, f := range prev.Files {
+			if _, ok := paths[f.Path]; !ok {
+				obsolete = append(obsolete, f)
+			}
+		}
+		removable, err := remover.Removable(root, db, obsolete, false)
+		if err != nil {
+			return fmt.Errorf("remove obsolete files of %s: %s", prev.PackageVersion(), err)
+		}
+		for _, name := range removable {
+			if err := txn.Remove(name); err != nil {
+				return err
+			}
 		}
 	}
 
-	return packages, nil
+	return nil
+}
+
+// installedMetadata returns metadata of the package to be recorded in the
+// installed database. Archives without a manifest don't have it, so it is
+// downloaded.
+func (d *PackageDownloader) installedMetadata(pv pkg.PackageVersion, manifest *archive.Manifest) (*pkg.Metadata, error) {
+	if manifest == nil {
+		return d.packageMetadata(pv)
+	}
+	if manifest.PackageVersion() != pv {
+		return nil, fmt.Errorf("archive of %s contains %s", pv, manifest.PackageVersion())
+	}
+	return &manifest.Metadata, nil
 }
 
-func (d *PackageDownloader) extractArchive(archivePath string) error {
+// openRoot opens the install root, creating it if needed. Files can only
+// be created inside it, even through symbolic links.
+func (d *PackageDownloader) openRoot() (*os.Root, error) {
+	prefix := d.config.Prefix
+	if prefix == "" {
+		prefix = "."
+	}
+	if err := os.MkdirAll(prefix, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenRoot(prefix)
+}
+
+// extractArchive stages files of the archive and returns its manifest,
+// which is nil for old archives, and the extracted files.
+func extractArchive(txn *transaction.Transaction, archivePath string) (*archive.Manifest, []archive.File, error) {
+	manifest, err := archive.ReadManifest(archivePath)
+	if errors.Is(err, archive.ErrNoManifest) {
+		log.Printf("%s has no manifest, files will not be verified\n", archivePath)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("read manifest: %s", err)
+	} else {
+		log.Printf("package %s built at %s, %d files\n", manifest.PackageVersion(), manifest.BuildTime, len(manifest.Files))
+	}
+	var manifestFiles map[string]archive.File
+	if manifest != nil {
+		manifestFiles = manifest.FilesByPath()
+	}
+
 	archiveFile, err := os.Open(archivePath)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	defer func() {
 		_ = archiveFile.Close()
 	}()
 
-	gzr, err := gzip.NewReader(archiveFile)
+	r, compression, err := archive.NewReader(archiveFile)
 	if err != nil {
-		return fmt.Errorf("gzip reader: %s", err)
+		return nil, nil, fmt.Errorf("decompress: %s", err)
 	}
 	defer func() {
-		_ = gzr.Close()
+		_ = r.Close()
 	}()
-	tr := tar.NewReader(gzr)
+	log.Printf("%s compression: %s\n", archivePath, compression)
+	tr := tar.NewReader(r)
 
-	createdDirs := make(map[string]struct{})
+	var files []archive.File
+	// symlinks are paths of the extracted symbolic links
+	symlinks := make(map[string]struct{})
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
-		if err == tar.ErrInsecurePath {
-			log.Printf("insecure path: %q, skipping\n", header.Name)
+		if err != nil && err != tar.ErrInsecurePath {
+			return nil, nil, fmt.Errorf("tar: %s", err)
+		}
+		if !filepath.IsLocal(header.Name) {
+			return nil, nil, fmt.Errorf("%q is outside the install root", header.Name)
+		}
+		if archive.IsReserved(header.Name) {
 			continue
 		}
-		if err != nil {
-			return fmt.Errorf("tar: %s", err)
+		if link, ok := underSymlink(header.Name, symlinks); ok {
+			return nil, nil, fmt.Errorf("%q is under symbolic link %q", header.Name, link)
 		}
 
-		dir := filepath.Dir(header.Name)
-		if _, ok := createdDirs[dir]; !ok {
-			log.Printf("creating dir %q\n", dir)
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return fmt.Errorf("mkdir: %s", err)
+		file, err := extractEntry(txn, tr, header, files)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%q: %s", header.Name, err)
+		}
+		if manifest != nil {
+			manifestFile, ok := manifestFiles[file.Path]
+			if !ok {
+				return nil, nil, fmt.Errorf("%q is not listed in the manifest", header.Name)
+			}
+			if err := checkManifestFile(file, manifestFile); err != nil {
+				return nil, nil, fmt.Errorf("%q does not match the manifest: %s", header.Name, err)
 			}
-			createdDirs[dir] = struct{}{}
 		}
+		files = append(files, file)
+		if file.Mode&fs.ModeSymlink != 0 {
+			symlinks[file.Path] = struct{}{}
+		}
+	}
 
-		log.Printf("extracting file %q\n", header.Name)
+	if manifest != nil && len(files) != len(manifest.Files) {
+		return nil, nil, fmt.Errorf("archive has %d of %d files listed in the manifest", len(files), len(manifest.Files))
+	}
 
-		if _, err := os.Stat(header.Name); !errors.Is(err, os.ErrNotExist) {
-			log.Printf("%q already exists, overwriting\n", header.Name)
-		}
+	return manifest, files, nil
+}
 
-		f, err := os.OpenFile(header.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode())
-		if err != nil {
-			return err
+// underSymlink returns the extracted symbolic link which is a parent
+// directory of the entry name. Files can't be extracted through symbolic
+// links: relative links are checked against their path in the archive.
+func underSymlink(name string, symlinks map[string]struct{}) (string, bool) {
+	for dir := path.Dir(path.Clean(name)); dir != "."; dir = path.Dir(dir) {
+		if _, ok := symlinks[dir]; ok {
+			return dir, true
 		}
-		defer func() {
-			_ = f.Close()
-		}()
+	}
+	return "", false
+}
 
-		if _, err := io.Copy(f, tr); err != nil {
-			return fmt.Errorf("copy: %s", err)
-		}
+// extractEntry stages the archive entry. Hard links may only point to the
+// extracted files.
+func extractEntry(txn *transaction.Transaction, tr *tar.Reader, header *tar.Header, extracted []archive.File) (archive.File, error) {
+	file := archive.File{
+		Path:    path.Clean(header.Name),
+		Mode:    header.FileInfo().Mode(),
+		ModTime: header.ModTime.UTC(),
+	}
 
-		if err := f.Close(); err != nil {
-			return fmt.Errorf("close file: %s", err)
+	switch header.Typeflag {
+	case tar.TypeDir:
+		log.Printf("extracting dir %q\n", file.Path)
+		return file, txn.Mkdir(file.Path, file.Mode, file.ModTime)
+	case tar.TypeSymlink:
+		log.Printf("extracting symlink %q -> %q\n", file.Path, header.Linkname)
+		file.Link = header.Linkname
+		return file, txn.Symlink(file.Path, file.Link)
+	case tar.TypeLink:
+		file.Link = path.Clean(header.Linkname)
+		i := slices.IndexFunc(extracted, func(f archive.File) bool { return f.Path == file.Link })
+		if i < 0 || !extracted[i].Mode.IsRegular() {
+			return file, fmt.Errorf("hard link to %q, which is not a file extracted before", header.Linkname)
 		}
+		log.Printf("extracting hard link %q -> %q\n", file.Path, file.Link)
+		file.Size = extracted[i].Size
+		file.SHA256 = extracted[i].SHA256
+		return file, txn.Link(file.Path, file.Link)
+	case tar.TypeReg:
+	default:
+		return file, fmt.Errorf("unsupported entry type %q", header.Typeflag)
+	}
+
+	log.Printf("extracting file %q\n", file.Path)
+
+	f, err := txn.Create(file.Path, file.Mode)
+	if err != nil {
+		return file, err
 	}
+	defer func() {
+		_ = f.Close()
+	}()
 
+	h := sha256.New()
+	file.Size, err = io.Copy(f, io.TeeReader(tr, h))
+	if err != nil {
+		return file, fmt.Errorf("copy: %s", err)
+	}
+	file.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	if err := f.Close(); err != nil {
+		return file, fmt.Errorf("close file: %s", err)
+	}
+	if err := txn.Chtimes(file.Path, file.ModTime); err != nil {
+		return file, err
+	}
+
+	return file, nil
+}
+
+// checkManifestFile compares the extracted file with its manifest entry.
+// Modification times are not in manifests of old archives and are not
+// compared.
+func checkManifestFile(file, manifestFile archive.File) error {
+	switch {
+	case file.Mode != manifestFile.Mode:
+		return fmt.Errorf("mode %s, expected %s", file.Mode, manifestFile.Mode)
+	case file.Link != manifestFile.Link:
+		return fmt.Errorf("link %q, expected %q", file.Link, manifestFile.Link)
+	case file.SHA256 != manifestFile.SHA256:
+		return fmt.Errorf("sha256 %s, expected %s", file.SHA256, manifestFile.SHA256)
+	}
 	return nil
 }
 
@@ -0,0 +1,612 @@
+package downloader
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/installed"
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/repository"
+	"github.com/alew-moose/pm/internal/transaction"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+// testEntry is an archive entry. Regular files have content, directories
+// and symbolic links have their type set.
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	link     string
+}
+
+var testModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// buildArchive returns a gzipped archive of the entries. The manifest is
+// added if metadata is not nil.
+func buildArchive(t *testing.T, entries []testEntry, metadata *pkg.Metadata) []byte {
+	t.Helper()
+	headers := make([]*tar.Header, 0, len(entries))
+	for _, e := range entries {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.name,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+			ModTime:  testModTime,
+		}
+		switch e.typeflag {
+		case tar.TypeDir:
+			header.Typeflag, header.Mode, header.Size = tar.TypeDir, 0755, 0
+		case tar.TypeSymlink:
+			header.Typeflag, header.Mode, header.Size = tar.TypeSymlink, 0777, 0
+			header.Linkname = e.link
+		}
+		headers = append(headers, header)
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if metadata != nil {
+		manifest := &archive.Manifest{Metadata: *metadata, BuildTime: testModTime}
+		for i, header := range headers {
+			f := archive.File{
+				Path:    path.Clean(header.Name),
+				Mode:    header.FileInfo().Mode(),
+				Link:    header.Linkname,
+				ModTime: header.ModTime,
+			}
+			if header.Typeflag == tar.TypeReg {
+				sum := sha256.Sum256([]byte(entries[i].content))
+				f.Size, f.SHA256 = header.Size, hex.EncodeToString(sum[:])
+			}
+			manifest.Files = append(manifest.Files, f)
+		}
+		if err := archive.WriteManifest(tw, manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entries[i].content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeArchive writes the archive of the package pv, given as
+// "name-ver", and returns its path. The manifest is added if
+// withManifest is set.
+func writeArchive(t *testing.T, pv string, entries []testEntry, withManifest bool) string {
+	t.Helper()
+	var metadata *pkg.Metadata
+	if withManifest {
+		pv, err := pkg.PackageVersionFromString(pv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata = &pkg.Metadata{Name: pv.Name, Version: pv.Version}
+	}
+	archivePath := filepath.Join(t.TempDir(), pv)
+	if err := os.WriteFile(archivePath, buildArchive(t, entries, metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+// publish puts the archive of the entries and its checksum into the
+// repository as name and returns the checksum. The manifest is added if
+// withManifest is set.
+func publish(t *testing.T, repo repository.Repository, name string, entries []testEntry, withManifest bool) string {
+	t.Helper()
+	var metadata *pkg.Metadata
+	if withManifest {
+		pv, err := pkg.PackageVersionFromString(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata = &pkg.Metadata{Name: pv.Name, Version: pv.Version}
+	}
+	return publishArchive(t, repo, name, buildArchive(t, entries, metadata))
+}
+
+// publishArchive puts the archive and its checksum into the repository as
+// name and returns the checksum.
+func publishArchive(t *testing.T, repo repository.Repository, name string, b []byte) string {
+	t.Helper()
+	archivePath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(archivePath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := checksum.FileSHA256(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.UploadPackageChecksum(repo, name, sum); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.UploadPackage(repo, name, archivePath); err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func newRepo(t *testing.T) repository.Repository {
+	t.Helper()
+	return repository.NewDir(filepath.Join(t.TempDir(), "repo"))
+}
+
+// testConfig returns a config installing the packages, given as
+// "name" or "name ver-spec", into a new install root.
+func testConfig(t *testing.T, packages ...string) *Config {
+	t.Helper()
+	return &Config{
+		Packages: testSpecs(t, packages...),
+		Prefix:   filepath.Join(t.TempDir(), "root"),
+	}
+}
+
+func update(t *testing.T, repo repository.Repository, config *Config) error {
+	t.Helper()
+	d, err := NewPackageDownloader(config, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.Download()
+}
+
+// openTestRoot creates the install root at prefix with the files.
+func openTestRoot(t *testing.T, prefix string, files map[string]string) *os.Root {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(prefix, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(prefix, 0755); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = root.Close()
+	})
+	return root
+}
+
+// readTree returns contents of the files in the install root except pm's
+// own ones. Directories end with "/" and symbolic links are "-> target".
+func readTree(t *testing.T, prefix string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.WalkDir(prefix, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(prefix, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		switch {
+		case name == ".":
+		case name == archive.Dir:
+			return filepath.SkipDir
+		case d.Type()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			tree[name] = "-> " + target
+		case d.IsDir():
+			tree[name+"/"] = ""
+		default:
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			tree[name] = string(b)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestExtractArchiveOutsideRoot(t *testing.T) {
+	tests := []testEntry{
+		{name: "../x", content: "x"},
+		{name: "/x", content: "x"},
+		{name: "a/../../x", content: "x"},
+		{name: "a/b/../../../x", content: "x"},
+		{name: "../a", typeflag: tar.TypeDir},
+	}
+
+	for i, test := range tests {
+		for _, withManifest := range []bool{false, true} {
+			prefix := filepath.Join(t.TempDir(), "root")
+			root := openTestRoot(t, prefix, map[string]string{"keep.txt": "keep"})
+			archivePath := writeArchive(t, "bad-1.0.0", []testEntry{{name: "ok.txt", content: "ok"}, test}, withManifest)
+
+			txn, err := transaction.Begin(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = extractArchive(txn, archivePath)
+			if err := txn.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+			if err == nil || !strings.Contains(err.Error(), "is outside the install root") {
+				t.Errorf("failed test #%d with manifest %t: got error %v, want outside the install root", i, withManifest, err)
+			}
+			if got, want := readTree(t, prefix), map[string]string{"keep.txt": "keep"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("failed test #%d with manifest %t: got tree %v, want %v", i, withManifest, got, want)
+			}
+			for _, name := range []string{"x", "a"} {
+				if _, err := os.Lstat(filepath.Join(filepath.Dir(prefix), name)); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("failed test #%d with manifest %t: %q created outside the root", i, withManifest, name)
+				}
+			}
+		}
+	}
+}
+
+// installArchive installs the archive of the package pv, given as
+// "name-ver", into the install root at prefix.
+func installArchive(t *testing.T, prefix, pv, archivePath string) error {
+	t.Helper()
+	p, err := pkg.PackageVersionFromString(pv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := checksum.FileSHA256(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := openTestRoot(t, prefix, nil)
+	db, err := installed.Load(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn, err := transaction.Begin(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = txn.Rollback()
+	}()
+	d := &PackageDownloader{config: &Config{Prefix: prefix}}
+	staged, err := d.stage(txn, download{
+		pkg:         &LockedPackage{Name: p.Name, Version: p.Version, SHA256: sum},
+		archivePath: archivePath,
+	})
+	if err != nil {
+		return err
+	}
+	if err := upgrade(root, txn, db, []installed.Package{*staged}); err != nil {
+		return err
+	}
+	b, err := db.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.WriteFile(installed.DBPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return txn.Commit()
+}
+
+func TestInstallUpgrade(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "root")
+	archivePath := writeArchive(t, "pkg-1.1.0", []testEntry{
+		{name: "a.txt", content: "a"},
+		{name: "b.txt", content: "b 1.1"},
+		{name: "m.txt", content: "m"},
+		{name: "old", typeflag: tar.TypeDir},
+		{name: "old/c.txt", content: "c"},
+	}, true)
+	if err := installArchive(t, prefix, "pkg-1.1.0", archivePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "m.txt"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath = writeArchive(t, "pkg-1.2.0", []testEntry{{name: "b.txt", content: "b 1.2"}}, true)
+	if err := installArchive(t, prefix, "pkg-1.2.0", archivePath); err != nil {
+		t.Fatalf("upgrade returned error %q", err)
+	}
+	want := map[string]string{
+		"b.txt": "b 1.2",
+		"m.txt": "modified",
+	}
+	if got := readTree(t, prefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tree %v, want %v", got, want)
+	}
+}
+
+func TestDownloadInstalled(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "root")
+	archivePath := writeArchive(t, "a-1.0.0", []testEntry{{name: "a.txt", content: "a"}}, true)
+	if err := installArchive(t, prefix, "a-1.0.0", archivePath); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := checksum.FileSHA256(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Packages: testSpecs(t, "a"),
+		Prefix:   prefix,
+		LockFile: filepath.Join(t.TempDir(), LockFileName),
+		Locked:   true,
+	}
+	lockFile := &LockFile{Requested: config.Packages, Packages: []LockedPackage{lockedPackage("a", 1, sum)}}
+	if err := lockFile.WriteFile(config.LockFile); err != nil {
+		t.Fatal(err)
+	}
+	// there is no repository, downloading anything would fail
+	d, err := NewPackageDownloader(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Download(); err != nil {
+		t.Fatalf("Download returned error %q, the installed package was downloaded again", err)
+	}
+	if got, want := readTree(t, prefix), map[string]string{"a.txt": "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tree %v, want %v", got, want)
+	}
+}
+
+func TestDownloadTwoPartVersion(t *testing.T) {
+	for _, withIndex := range []bool{false, true} {
+		repo := newRepo(t)
+		// published by pm before versions had three parts
+		sum := publish(t, repo, "packet-1.10", []testEntry{{name: "a.txt", content: "old"}}, false)
+		publish(t, repo, "packet-1.9.0", []testEntry{{name: "a.txt", content: "older"}}, true)
+		if withIndex {
+			index := &repository.Index{}
+			index.Add(repository.IndexPackage{
+				Metadata: pkg.Metadata{Name: "packet", Version: version.Version{Major: 1, Minor: 10}},
+				File:     "packet-1.10",
+				SHA256:   sum,
+			})
+			index.Add(repository.IndexPackage{
+				Metadata: pkg.Metadata{Name: "packet", Version: version.Version{Major: 1, Minor: 9}},
+				File:     "packet-1.9.0",
+				SHA256:   "unused",
+			})
+			if err := repository.WriteIndex(repo, index); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		config := testConfig(t, "packet")
+		config.LockFile = filepath.Join(t.TempDir(), LockFileName)
+		if err := update(t, repo, config); err != nil {
+			t.Fatalf("failed test with index %t: Download returned error %q", withIndex, err)
+		}
+		if got, want := readTree(t, config.Prefix), map[string]string{"a.txt": "old"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("failed test with index %t: got tree %v, want %v", withIndex, got, want)
+		}
+
+		// the lock file keeps the name of the archive
+		lockFile, err := LockFileFromFile(config.LockFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lockFile.Packages) != 1 || lockFile.Packages[0].File != "packet-1.10" {
+			t.Fatalf("failed test with index %t: locked %+v", withIndex, lockFile.Packages)
+		}
+		config.Locked = true
+		config.Prefix = filepath.Join(t.TempDir(), "root")
+		if err := update(t, repo, config); err != nil {
+			t.Errorf("failed test with index %t: locked Download returned error %q", withIndex, err)
+		}
+	}
+}
+
+func TestDownloadConflictsBeforeStaging(t *testing.T) {
+	repo := newRepo(t)
+	publish(t, repo, "a-1.0.0", []testEntry{{name: "same.txt", content: "a"}}, true)
+	// only the manifest of b can be read, extracting it fails
+	big := make([]byte, 1<<16)
+	if _, err := rand.Read(big); err != nil {
+		t.Fatal(err)
+	}
+	b := buildArchive(t, []testEntry{{name: "same.txt", content: "b"}, {name: "big", content: string(big)}},
+		&pkg.Metadata{Name: "b", Version: version.Version{Major: 1}})
+	publishArchive(t, repo, "b-1.0.0", b[:len(b)/2])
+
+	config := testConfig(t, "a", "b")
+	err := update(t, repo, config)
+	var conflictErr *installed.ConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("got error %v, want file conflicts", err)
+	}
+	if _, err := os.Lstat(filepath.Join(config.Prefix, transaction.Dir)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("transaction was started: %v", err)
+	}
+	if got := readTree(t, config.Prefix); len(got) != 0 {
+		t.Errorf("got tree %v, want it empty", got)
+	}
+}
+
+func TestDownloadThroughSymlink(t *testing.T) {
+	tests := []struct {
+		entries []testEntry
+		onDisk  bool // "a -> ." exists in the install root
+	}{
+		{
+			entries: []testEntry{
+				{name: "a", typeflag: tar.TypeSymlink, link: "."},
+				{name: "a/a/a/b", typeflag: tar.TypeSymlink, link: "../../../etc"},
+			},
+		},
+		{
+			entries: []testEntry{
+				{name: "a", typeflag: tar.TypeSymlink, link: "."},
+				{name: "a/file", content: "x"},
+			},
+		},
+		{
+			entries: []testEntry{{name: "a/a/a/b", typeflag: tar.TypeSymlink, link: "../../../etc"}},
+			onDisk:  true,
+		},
+	}
+
+	for i, test := range tests {
+		for _, withManifest := range []bool{false, true} {
+			repo := newRepo(t)
+			publish(t, repo, "bad-1.0.0", test.entries, withManifest)
+			config := testConfig(t, "bad")
+			want := map[string]string{}
+			if test.onDisk {
+				if err := os.MkdirAll(config.Prefix, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(".", filepath.Join(config.Prefix, "a")); err != nil {
+					t.Fatal(err)
+				}
+				want["a"] = "-> ."
+			}
+
+			err := update(t, repo, config)
+			if err == nil || !strings.Contains(err.Error(), "symbolic link") {
+				t.Errorf("failed test #%d with manifest %t: got error %v, want symbolic link error", i, withManifest, err)
+			}
+			if got := readTree(t, config.Prefix); !reflect.DeepEqual(got, want) {
+				t.Errorf("failed test #%d with manifest %t: got tree %v, want %v", i, withManifest, got, want)
+			}
+		}
+	}
+}
+
+func TestDownloadThroughDirLink(t *testing.T) {
+	repo := newRepo(t)
+	publish(t, repo, "pkg-1.0.0", []testEntry{
+		{name: "lib", typeflag: tar.TypeDir},
+		{name: "lib/a.so", content: "a"},
+	}, true)
+	publish(t, repo, "pkg-2.0.0", []testEntry{{name: "bin/app", content: "app"}}, true)
+
+	config := testConfig(t, "pkg 1.0.0")
+	if err := os.MkdirAll(filepath.Join(config.Prefix, "lib64"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("lib64", filepath.Join(config.Prefix, "lib")); err != nil {
+		t.Fatal(err)
+	}
+	if err := update(t, repo, config); err != nil {
+		t.Fatalf("Download returned error %q", err)
+	}
+	want := map[string]string{"lib": "-> lib64", "lib64/": "", "lib64/a.so": "a"}
+	if got := readTree(t, config.Prefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tree %v, want %v", got, want)
+	}
+
+	// the link is not removed with the directory of the package
+	config.Packages = testSpecs(t, "pkg 2.0.0")
+	if err := update(t, repo, config); err != nil {
+		t.Fatalf("Download of the upgrade returned error %q", err)
+	}
+	want = map[string]string{"lib": "-> lib64", "lib64/": "", "bin/": "", "bin/app": "app"}
+	if got := readTree(t, config.Prefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("after the upgrade got tree %v, want %v", got, want)
+	}
+}
+
+func TestDownloadDependencies(t *testing.T) {
+	repo := newRepo(t)
+	// publishDeps publishes the package with a file named after it and
+	// its dependencies in the metadata
+	publishDeps := func(name string, deps ...string) {
+		t.Helper()
+		pv, err := pkg.PackageVersionFromString(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata := &pkg.Metadata{Name: pv.Name, Version: pv.Version, Dependencies: testSpecs(t, deps...)}
+		publishArchive(t, repo, name, buildArchive(t, []testEntry{{name: string(pv.Name), content: name}}, metadata))
+		b, err := json.Marshal(metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repository.UploadPackageMetadata(repo, name, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publishDeps("app-1.0.0", "lib >=1.0 <2.0")
+	publishDeps("lib-1.1.0", "base")
+	publishDeps("lib-2.0.0", "base", "other")
+	publishDeps("base-1.0.0")
+	publishDeps("other-1.0.0")
+
+	config := testConfig(t, "app")
+	config.LockFile = filepath.Join(t.TempDir(), LockFileName)
+	if err := update(t, repo, config); err != nil {
+		t.Fatalf("Download returned error %q", err)
+	}
+
+	want := map[string]string{"app": "app-1.0.0", "lib": "lib-1.1.0", "base": "base-1.0.0"}
+	if got := readTree(t, config.Prefix); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tree %v, want %v", got, want)
+	}
+
+	// dependencies are installed before the packages requiring them
+	lockFile, err := LockFileFromFile(config.LockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, p := range lockFile.Packages {
+		order = append(order, p.PackageVersion().String())
+	}
+	if want := []string{"base-1.0.0", "lib-1.1.0", "app-1.0.0"}; !slices.Equal(order, want) {
+		t.Errorf("got packages %q, want %q", order, want)
+	}
+
+	root := openTestRoot(t, config.Prefix, nil)
+	db, err := installed.Load(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := db.Package("lib"); !ok || len(p.Dependencies) != 1 || p.Dependencies[0].Name != "base" {
+		t.Errorf("got installed lib %+v, want it depending on base", p)
+	}
+}
@@ -0,0 +1,130 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+// LockFileName is the name of the lock file written next to the packages
+// config.
+const LockFileName = "pm.lock"
+
+// LockFile records exact package versions and archive checksums selected
+// for the requested packages, in installation order.
+type LockFile struct {
+	Requested []pkg.PackageVersionSpec `json:"requested"`
+	Packages  []LockedPackage          `json:"packages"`
+}
+
+type LockedPackage struct {
+	Name    pkg.PackageName `json:"name"`
+	Version version.Version `json:"ver"`
+	// File is the name of the archive if it differs from <name>-<ver>,
+	// as for old packages with two-part versions.
+	File   string `json:"file,omitempty"`
+	SHA256 string `json:"sha256"`
+}
+
+func (lp LockedPackage) PackageVersion() pkg.PackageVersion {
+	return pkg.PackageVersion{Name: lp.Name, Version: lp.Version}
+}
+
+// FileName returns the name of the archive in the repository.
+func (lp LockedPackage) FileName() string {
+	if lp.File == "" {
+		return lp.PackageVersion().String()
+	}
+	return lp.File
+}
+
+func LockFileFromFile(path string) (*LockFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lockFile LockFile
+	if err := json.Unmarshal(b, &lockFile); err != nil {
+		return nil, fmt.Errorf("unmarshal json: %s", err)
+	}
+
+	return &lockFile, nil
+}
+
+// WriteFile replaces the lock file atomically.
+func (lf *LockFile) WriteFile(path string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(lf); err != nil {
+		return fmt.Errorf("marshal json: %s", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close %q: %s", f.Name(), err)
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// CheckFresh returns an error if the lock file was generated for other
+// requested packages or does not satisfy them.
+func (lf *LockFile) CheckFresh(requested []pkg.PackageVersionSpec) error {
+	if !slices.Equal(specStrings(lf.Requested), specStrings(requested)) {
+		return fmt.Errorf("lock file is stale: it was generated for %s, requested %s",
+			stringersSliceToString(lf.Requested), stringersSliceToString(requested))
+	}
+
+	locked := make(map[pkg.PackageName]pkg.PackageVersion, len(lf.Packages))
+	for _, lp := range lf.Packages {
+		if err := lp.PackageVersion().Validate(); err != nil {
+			return fmt.Errorf("invalid locked package: %s", err)
+		}
+		if lp.SHA256 == "" {
+			return fmt.Errorf("locked package %s has no checksum", lp.PackageVersion())
+		}
+		if pv, err := pkg.PackageVersionFromString(lp.FileName()); err != nil || pv != lp.PackageVersion() {
+			return fmt.Errorf("locked package %s has invalid file %q", lp.PackageVersion(), lp.FileName())
+		}
+		locked[lp.Name] = lp.PackageVersion()
+	}
+	for _, pvs := range requested {
+		pv, ok := locked[pvs.Name]
+		if !ok || !pvs.Match(pv) {
+			return fmt.Errorf("lock file is stale: no locked package satisfies %s", pvs)
+		}
+	}
+
+	return nil
+}
+
+// specStrings returns sorted string representations of specs, so that
+// the order of packages in the config does not matter.
+func specStrings(specs []pkg.PackageVersionSpec) []string {
+	strs := make([]string, 0, len(specs))
+	for _, pvs := range specs {
+		strs = append(strs, pvs.String())
+	}
+	slices.Sort(strs)
+	return strs
+}
@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+// testSpecs parses the packages, given as "name" or "name ver-spec".
+func testSpecs(t *testing.T, packages ...string) []pkg.PackageVersionSpec {
+	t.Helper()
+	var specs []pkg.PackageVersionSpec
+	for _, p := range packages {
+		name, spec, _ := strings.Cut(p, " ")
+		pvs := pkg.PackageVersionSpec{Name: pkg.PackageName(name)}
+		if spec != "" {
+			vs, err := version.VersionSpecFromString(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pvs.VersionSpec = vs
+		}
+		specs = append(specs, pvs)
+	}
+	FillDefaultVersionSpecs(specs)
+	return specs
+}
+
+func lockedPackage(name string, major uint64, sum string) LockedPackage {
+	return LockedPackage{Name: pkg.PackageName(name), Version: version.Version{Major: major}, SHA256: sum}
+}
+
+func TestCheckFresh(t *testing.T) {
+	requested := testSpecs(t, "a >=1.0", "b")
+	tests := []struct {
+		requested []pkg.PackageVersionSpec
+		packages  []LockedPackage
+		wantErr   string
+	}{
+		{
+			requested: requested,
+			packages:  []LockedPackage{lockedPackage("a", 1, "1"), lockedPackage("b", 2, "2")},
+		},
+		{
+			// the order of requested packages doesn't matter
+			requested: []pkg.PackageVersionSpec{requested[1], requested[0]},
+			packages:  []LockedPackage{lockedPackage("a", 1, "1"), lockedPackage("b", 2, "2")},
+		},
+		{
+			requested: requested[:1],
+			packages:  []LockedPackage{lockedPackage("a", 1, "1"), lockedPackage("b", 2, "2")},
+			wantErr:   "lock file is stale: it was generated for",
+		},
+		{
+			requested: testSpecs(t, "a >=2.0", "b"),
+			packages:  []LockedPackage{lockedPackage("a", 1, "1"), lockedPackage("b", 2, "2")},
+			wantErr:   "lock file is stale: it was generated for",
+		},
+		{
+			requested: requested,
+			packages:  []LockedPackage{lockedPackage("b", 2, "2")},
+			wantErr:   "no locked package satisfies a(ver >=1.0.0)",
+		},
+		{
+			requested: requested,
+			packages:  []LockedPackage{lockedPackage("a", 1, "1"), {Name: "b", Version: version.Version{Major: 2}}},
+			wantErr:   "locked package b-2.0.0 has no checksum",
+		},
+		{
+			requested: requested,
+			packages:  []LockedPackage{lockedPackage("a", 1, ""), lockedPackage("b", 2, "2")},
+			wantErr:   "locked package a-1.0.0 has no checksum",
+		},
+		{
+			requested: requested,
+			packages: []LockedPackage{
+				{Name: "a", Version: version.Version{Major: 1}, File: "a-1.0", SHA256: "1"},
+				lockedPackage("b", 2, "2"),
+			},
+		},
+		{
+			requested: requested,
+			packages: []LockedPackage{
+				{Name: "a", Version: version.Version{Major: 1}, File: "a-2.0", SHA256: "1"},
+				lockedPackage("b", 2, "2"),
+			},
+			wantErr: `locked package a-1.0.0 has invalid file "a-2.0"`,
+		},
+	}
+
+	for i, test := range tests {
+		lockFile := &LockFile{Requested: requested, Packages: test.packages}
+		err := lockFile.CheckFresh(test.requested)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("failed test #%d: unexpected error %q", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("failed test #%d: got error %v, want %q", i, err, test.wantErr)
+		}
+	}
+}
+
+func TestLockFileWriteFile(t *testing.T) {
+	lockFile := &LockFile{
+		Requested: testSpecs(t, "a >=1.0 <2.0"),
+		Packages:  []LockedPackage{lockedPackage("a", 1, "1")},
+	}
+	path := filepath.Join(t.TempDir(), LockFileName)
+	for range 2 {
+		if err := lockFile.WriteFile(path); err != nil {
+			t.Fatalf("WriteFile returned error %q", err)
+		}
+	}
+	got, err := LockFileFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, lockFile) {
+		t.Errorf("got %+v, want %+v", got, lockFile)
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) > 0 {
+		t.Errorf("temporary files left: %q", matches)
+	}
+}
+
+func TestDownloadLocked(t *testing.T) {
+	repo := newRepo(t)
+	publish(t, repo, "a-1.0.0", []testEntry{{name: "a.txt", content: "a 1"}}, true)
+
+	config := testConfig(t, "a")
+	config.LockFile = filepath.Join(t.TempDir(), LockFileName)
+	if err := update(t, repo, config); err != nil {
+		t.Fatal(err)
+	}
+
+	// a newer version is ignored by a locked update
+	publish(t, repo, "a-1.1.0", []testEntry{{name: "a.txt", content: "a 1.1"}}, true)
+	config.Locked = true
+	config.Prefix = filepath.Join(t.TempDir(), "root")
+	if err := update(t, repo, config); err != nil {
+		t.Fatalf("locked Download returned error %q", err)
+	}
+	if got, want := readTree(t, config.Prefix), map[string]string{"a.txt": "a 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tree %v, want %v", got, want)
+	}
+
+	// the archive was republished with other contents
+	if err := repo.Delete("a-1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete("a-1.0.0.sha256"); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, repo, "a-1.0.0", []testEntry{{name: "a.txt", content: "evil"}}, true)
+	config.Prefix = filepath.Join(t.TempDir(), "root")
+	err := update(t, repo, config)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch for a-1.0.0: locked") {
+		t.Errorf("locked Download of a changed archive: got error %v, want checksum mismatch", err)
+	}
+	if got := readTree(t, config.Prefix); len(got) != 0 {
+		t.Errorf("got tree %v after a checksum mismatch, want it empty", got)
+	}
+
+	// the lock file doesn't match the requested packages
+	config.Packages = testSpecs(t, "a >=2.0")
+	err = update(t, repo, config)
+	if err == nil || !strings.Contains(err.Error(), "lock file is stale") {
+		t.Errorf("locked Download of other packages: got error %v, want stale lock file", err)
+	}
+}
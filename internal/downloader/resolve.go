@@ -0,0 +1,153 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/repository"
+	"github.com/alew-moose/pm/internal/resolver"
+)
+
+// findPackages selects a version for every requested package and for all
+// of their dependencies, recursively. Packages are returned in dependency
+// order: every package comes after the packages it depends on.
+func (d *PackageDownloader) findPackages() ([]pkg.PackageVersion, error) {
+	available, err := d.availablePackages()
+	if err != nil {
+		return nil, err
+	}
+
+	source := &repositorySource{
+		downloader: d,
+		available:  available,
+	}
+	packages, err := resolver.Resolve(source, d.config.Packages)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pv := range packages {
+		log.Printf("selected package %s\n", pv)
+	}
+
+	return packages, nil
+}
+
+// availablePackages returns versions of every package in the repository,
+// greatest first, and remembers names of their archives. They are read
+// from the index if the repository has one, and then so is the metadata.
+func (d *PackageDownloader) availablePackages() (map[pkg.PackageName][]pkg.PackageVersion, error) {
+	d.files = make(map[pkg.PackageVersion]string)
+	index, err := repository.ReadIndex(d.repo)
+	switch {
+	case err == nil:
+		d.indexed = make(map[pkg.PackageVersion]*pkg.Metadata, len(index.Packages))
+		for _, p := range index.Packages {
+			pv := p.PackageVersion()
+			d.indexed[pv] = &p.Metadata
+			d.files[pv] = p.FileName()
+		}
+	case errors.Is(err, os.ErrNotExist):
+		log.Println("repository has no index, listing packages")
+		if err := d.listPackages(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("read index: %s", err)
+	}
+
+	available := make(map[pkg.PackageName][]pkg.PackageVersion)
+	for pv := range d.files {
+		available[pv.Name] = append(available[pv.Name], pv)
+	}
+	for _, pvs := range available {
+		slices.SortFunc(pvs, func(a, b pkg.PackageVersion) int {
+			return b.Version.Compare(a.Version)
+		})
+	}
+
+	return available, nil
+}
+
+func (d *PackageDownloader) listPackages() error {
+	names, err := repository.Packages(d.repo)
+	if err != nil {
+		return fmt.Errorf("get packages: %s", err)
+	}
+
+	for _, name := range names {
+		pv, err := pkg.PackageVersionFromString(name)
+		if err != nil {
+			log.Printf("invalid package name %q: %s, skipping\n", name, err)
+			continue
+		}
+		if other, ok := d.files[pv]; ok {
+			log.Printf("packages %q and %q have the same version, using %q\n", other, name, min(other, name))
+			name = min(other, name)
+		}
+		d.files[pv] = name
+	}
+
+	return nil
+}
+
+// fileName returns the name of the package archive in the repository.
+// Old packages with two-part versions keep them in their names.
+func (d *PackageDownloader) fileName(pv pkg.PackageVersion) string {
+	if name, ok := d.files[pv]; ok {
+		return name
+	}
+	return pv.String()
+}
+
+func (d *PackageDownloader) packageMetadata(pv pkg.PackageVersion) (*pkg.Metadata, error) {
+	if metadata, ok := d.indexed[pv]; ok {
+		return metadata, nil
+	}
+
+	b, err := repository.DownloadPackageMetadata(d.repo, d.fileName(pv))
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("package %s has no metadata, assuming no dependencies\n", pv)
+		return &pkg.Metadata{Name: pv.Name, Version: pv.Version}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("download metadata of %s: %s", pv, err)
+	}
+
+	var metadata pkg.Metadata
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		return nil, fmt.Errorf("parse metadata of %s: %s", pv, err)
+	}
+	if err := metadata.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s: %s", pv, err)
+	}
+	if metadata.PackageVersion() != pv {
+		return nil, fmt.Errorf("metadata of %s describes %s", pv, metadata.PackageVersion())
+	}
+
+	return &metadata, nil
+}
+
+// repositorySource provides packages found in the repository to the
+// resolver.
+type repositorySource struct {
+	downloader *PackageDownloader
+	available  map[pkg.PackageName][]pkg.PackageVersion
+}
+
+func (s *repositorySource) Versions(name pkg.PackageName) []pkg.PackageVersion {
+	return s.available[name]
+}
+
+func (s *repositorySource) Dependencies(pv pkg.PackageVersion) ([]pkg.PackageVersionSpec, error) {
+	metadata, err := s.downloader.packageMetadata(pv)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Dependencies, nil
+}
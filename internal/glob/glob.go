@@ -0,0 +1,176 @@
+// Package glob implements globbing with "**" and gitignore-style path
+// patterns. Paths and patterns always use "/" as the separator.
+package glob
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Match reports whether name matches pattern. Besides path.Match syntax,
+// a "**" segment matches zero or more path segments.
+func Match(pattern, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(patterns, names []string) (bool, error) {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			patterns = patterns[1:]
+			for i := 0; i <= len(names); i++ {
+				ok, err := matchSegments(patterns, names[i:])
+				if ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(names) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(patterns[0], names[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0, nil
+}
+
+// Validate checks the pattern syntax.
+func Validate(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasMeta(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+// Base returns the leading part of the pattern without wildcards, e.g.
+// "build/out" for "./build/out/**/*.so".
+func Base(pattern string) string {
+	segments := strings.Split(cleanPattern(pattern), "/")
+	i := 0
+	for i < len(segments) && !hasMeta(segments[i]) {
+		i++
+	}
+	if i == len(segments) {
+		return path.Dir(cleanPattern(pattern))
+	}
+	base := strings.Join(segments[:i], "/")
+	if base == "" && strings.HasPrefix(pattern, "/") {
+		return "/"
+	}
+	if base == "" {
+		return "."
+	}
+	return base
+}
+
+func cleanPattern(pattern string) string {
+	return path.Clean(filepath.ToSlash(pattern))
+}
+
+// Glob returns names of files and directories matching the pattern, like
+// filepath.Glob, but also supports "**". Symbolic links to directories are
+// not followed by "**". Names are sorted and cleaned.
+func Glob(pattern string) ([]string, error) {
+	pattern = cleanPattern(pattern)
+	if err := Validate(pattern); err != nil {
+		return nil, err
+	}
+
+	base := Base(pattern)
+	var segments []string
+	if base == "." {
+		segments = strings.Split(pattern, "/")
+	} else if rest, ok := strings.CutPrefix(pattern, base); ok {
+		segments = strings.Split(strings.TrimPrefix(rest, "/"), "/")
+	}
+	if len(segments) == 1 && segments[0] == "" {
+		segments = nil
+	}
+
+	matches := make(map[string]struct{})
+	if err := glob(base, segments, matches); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(matches))
+	for name := range matches {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names, nil
+}
+
+func glob(dir string, segments []string, matches map[string]struct{}) error {
+	if len(segments) == 0 {
+		if _, err := os.Lstat(dir); err == nil {
+			matches[dir] = struct{}{}
+		}
+		return nil
+	}
+
+	segment := segments[0]
+	if !hasMeta(segment) && segment != "**" {
+		return glob(join(dir, segment), segments[1:], matches)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) || isNotDir(dir) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if segment == "**" {
+		if err := glob(dir, segments[1:], matches); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				if err := glob(join(dir, entry.Name()), segments, matches); err != nil {
+					return err
+				}
+			} else if len(segments) == 1 {
+				// a trailing "**" matches everything inside dir
+				matches[join(dir, entry.Name())] = struct{}{}
+			}
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		if ok, _ := path.Match(segment, entry.Name()); ok {
+			if err := glob(join(dir, entry.Name()), segments[1:], matches); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isNotDir(name string) bool {
+	fileInfo, err := os.Stat(name)
+	return err == nil && !fileInfo.IsDir()
+}
+
+func join(dir, name string) string {
+	if dir == "." {
+		return name
+	}
+	return path.Join(dir, name)
+}
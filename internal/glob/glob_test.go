@@ -0,0 +1,133 @@
+package glob
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		name      string
+		wantMatch bool
+	}{
+		{pattern: "*.txt", name: "a.txt", wantMatch: true},
+		{pattern: "*.txt", name: "dir/a.txt", wantMatch: false},
+		{pattern: "**/*.txt", name: "a.txt", wantMatch: true},
+		{pattern: "**/*.txt", name: "dir/sub/a.txt", wantMatch: true},
+		{pattern: "dir/**", name: "dir", wantMatch: true},
+		{pattern: "dir/**", name: "dir/sub/a.txt", wantMatch: true},
+		{pattern: "dir/**/a.txt", name: "dir/a.txt", wantMatch: true},
+		{pattern: "dir/**/a.txt", name: "dir/x/y/a.txt", wantMatch: true},
+		{pattern: "dir/**/a.txt", name: "other/a.txt", wantMatch: false},
+		{pattern: "d?r/[ab].txt", name: "dir/b.txt", wantMatch: true},
+		{pattern: "dir/*", name: "dir/sub/a.txt", wantMatch: false},
+	}
+
+	for ti, tt := range tests {
+		match, err := Match(tt.pattern, tt.name)
+		if err != nil {
+			t.Errorf("failed test #%d: Match(%q, %q) returned error %q", ti, tt.pattern, tt.name, err)
+			continue
+		}
+		if match != tt.wantMatch {
+			t.Errorf("failed test #%d: Match(%q, %q): got %t, want %t", ti, tt.pattern, tt.name, match, tt.wantMatch)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.tmp", "sub/c.txt", "sub/deep/d.txt", "sub/deep/e.tmp"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{pattern: "*.txt", want: []string{"a.txt"}},
+		{pattern: "./*.txt", want: []string{"a.txt"}},
+		{pattern: "**/*.txt", want: []string{"a.txt", "sub/c.txt", "sub/deep/d.txt"}},
+		{pattern: "sub/**/*.tmp", want: []string{"sub/deep/e.tmp"}},
+		{pattern: "sub/*", want: []string{"sub/c.txt", "sub/deep"}},
+		{pattern: "sub/deep/d.txt", want: []string{"sub/deep/d.txt"}},
+		{pattern: "sub/**", want: []string{"sub", "sub/c.txt", "sub/deep", "sub/deep/d.txt", "sub/deep/e.tmp"}},
+		{pattern: "missing/**", want: []string{}},
+		{pattern: "a.txt/*", want: []string{}},
+	}
+
+	for ti, tt := range tests {
+		got, err := Glob(tt.pattern)
+		if err != nil {
+			t.Errorf("failed test #%d: Glob(%q) returned error %q", ti, tt.pattern, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("failed test #%d: Glob(%q): got %q, want %q", ti, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestBase(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{pattern: "./build/out/**/*.so", want: "build/out"},
+		{pattern: "*.txt", want: "."},
+		{pattern: "build/tool", want: "build"},
+		{pattern: "/opt/*/bin", want: "/opt"},
+		{pattern: "/*", want: "/"},
+	}
+	for _, tt := range tests {
+		if got := Base(tt.pattern); got != tt.want {
+			t.Errorf("Base(%q): got %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestPatternsMatchPath(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		isDir    bool
+		want     bool
+	}{
+		{patterns: []string{"*.tmp"}, name: "a.tmp", want: true},
+		{patterns: []string{"*.tmp"}, name: "sub/a.tmp", want: true},
+		{patterns: []string{"*.tmp"}, name: "a.tmp.txt", want: false},
+		{patterns: []string{"/*.tmp"}, name: "sub/a.tmp", want: false},
+		{patterns: []string{"sub/*.tmp"}, name: "sub/a.tmp", want: true},
+		{patterns: []string{"sub/*.tmp"}, name: "other/sub/a.tmp", want: false},
+		{patterns: []string{"*.tmp", "!keep.tmp"}, name: "keep.tmp", want: false},
+		{patterns: []string{"*.tmp", "!keep.tmp"}, name: "drop.tmp", want: true},
+		{patterns: []string{"!keep.tmp", "*.tmp"}, name: "keep.tmp", want: true},
+		{patterns: []string{"cache/"}, name: "cache", want: false},
+		{patterns: []string{"cache/"}, name: "cache", isDir: true, want: true},
+		{patterns: []string{"cache/"}, name: "sub/cache/a.txt", want: true},
+		{patterns: []string{"cache/", "!cache/keep.txt"}, name: "cache/keep.txt", want: true},
+		{patterns: []string{"**/logs/**"}, name: "a/logs/b/c.log", want: true},
+		{patterns: []string{`\!important`}, name: "!important", want: true},
+	}
+
+	for ti, tt := range tests {
+		patterns, err := ParsePatterns(tt.patterns)
+		if err != nil {
+			t.Errorf("failed test #%d: ParsePatterns(%q) returned error %q", ti, tt.patterns, err)
+			continue
+		}
+		if got := patterns.MatchPath(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("failed test #%d: %q match %q: got %t, want %t", ti, tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package glob
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Pattern is a gitignore-style pattern:
+//   - a pattern without a slash matches a name at any depth, otherwise it
+//     is relative to the base directory (a leading slash is optional);
+//   - a trailing slash makes the pattern match directories only;
+//   - a leading "!" negates the pattern;
+//   - "**" matches zero or more directories.
+type Pattern struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+func ParsePattern(s string) (Pattern, error) {
+	var p Pattern
+
+	if strings.HasPrefix(s, `\!`) || strings.HasPrefix(s, `\#`) {
+		s = s[1:]
+	} else if rest, ok := strings.CutPrefix(s, "!"); ok {
+		p.negate = true
+		s = rest
+	}
+	if rest, ok := strings.CutSuffix(s, "/"); ok {
+		p.dirOnly = true
+		s = rest
+	}
+	if s == "" {
+		return p, errors.New("empty pattern")
+	}
+
+	if rest, ok := strings.CutPrefix(s, "/"); ok {
+		s = rest
+	} else if !strings.Contains(s, "/") {
+		s = "**/" + s
+	}
+	if err := Validate(s); err != nil {
+		return p, err
+	}
+	p.pattern = s
+
+	return p, nil
+}
+
+func (p Pattern) String() string {
+	s := p.pattern
+	if p.dirOnly {
+		s += "/"
+	}
+	if p.negate {
+		s = "!" + s
+	}
+	return s
+}
+
+func (p Pattern) match(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	ok, _ := Match(p.pattern, name)
+	return ok
+}
+
+// Patterns is a list of gitignore-style patterns where the last matching
+// pattern wins.
+type Patterns []Pattern
+
+func ParsePatterns(strs []string) (Patterns, error) {
+	patterns := make(Patterns, 0, len(strs))
+	for _, s := range strs {
+		p, err := ParsePattern(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", s, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// Match reports whether the last pattern matching name is not negated.
+// name is relative to the base directory.
+func (ps Patterns) Match(name string, isDir bool) bool {
+	matched := false
+	for _, p := range ps {
+		if p.match(name, isDir) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// MatchPath is like Match, but also reports true if any parent directory
+// of name matches: as in gitignore, a file can't be re-included if its
+// directory is excluded.
+func (ps Patterns) MatchPath(name string, isDir bool) bool {
+	name = path.Clean(name)
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' && ps.Match(name[:i], true) {
+			return true
+		}
+	}
+	return ps.Match(name, isDir)
+}
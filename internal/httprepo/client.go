@@ -0,0 +1,219 @@
+// Package httprepo implements a read-only repository served over HTTP(S),
+// e.g. a static directory with an autoindex listing.
+package httprepo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alew-moose/pm/internal/repository"
+)
+
+// maxListingSize limits the size of a directory listing.
+const maxListingSize = 64 << 20
+
+// Client reads a repository from a base URL: files are fetched from
+// <base>/<name>, and the listing is the response for the base URL itself.
+type Client struct {
+	base   *url.URL
+	config *Config
+	client *http.Client
+}
+
+var _ repository.Repository = (*Client)(nil)
+
+func NewClient(base *url.URL, config *Config) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("validate config: %s", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Minute
+	if config.CAFile != "" {
+		pool, err := certPool(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load CA file: %s", err)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	base = base.JoinPath("/")
+	return &Client{
+		base:   base,
+		config: config,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// certPool returns the system certificate pool with certificates from the
+// PEM file added.
+func certPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		log.Printf("failed to load system certificates: %s\n", err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+	return pool, nil
+}
+
+// List reads a JSON listing in the format of nginx "autoindex_format
+// json" or links of an HTML listing. Directories, links to other
+// directories and hidden files are skipped.
+func (c *Client) List() ([]repository.FileInfo, error) {
+	resp, err := c.do(http.MethodGet, c.base)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxListingSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read listing: %s", err)
+	}
+	if len(b) > maxListingSize {
+		return nil, fmt.Errorf("listing is larger than %d bytes", maxListingSize)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		return parseJSONListing(b)
+	}
+	return parseHTMLListing(b), nil
+}
+
+type jsonListingEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	MTime string `json:"mtime"`
+	Size  int64  `json:"size"`
+}
+
+func parseJSONListing(b []byte) ([]repository.FileInfo, error) {
+	var entries []jsonListingEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("parse listing: %s", err)
+	}
+	files := make([]repository.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type != "file" || !isFileName(entry.Name) {
+			continue
+		}
+		// nginx uses RFC 1123 dates
+		mtime, _ := time.Parse(time.RFC1123, entry.MTime)
+		files = append(files, repository.FileInfo{Name: entry.Name, Size: entry.Size, ModTime: mtime})
+	}
+	return files, nil
+}
+
+var hrefRe = regexp.MustCompile(`(?i)href\s*=\s*"([^"]*)"`)
+
+func parseHTMLListing(b []byte) []repository.FileInfo {
+	seen := make(map[string]struct{})
+	var files []repository.FileInfo
+	for _, match := range hrefRe.FindAllSubmatch(b, -1) {
+		href := html.UnescapeString(string(match[1]))
+		if strings.ContainsAny(href, "?#:") {
+			// sorting links, anchors and absolute URLs
+			continue
+		}
+		name, err := url.PathUnescape(href)
+		if err != nil || !isFileName(name) {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		files = append(files, repository.FileInfo{Name: name})
+	}
+	return files
+}
+
+func isFileName(name string) bool {
+	return name != "" && !strings.ContainsRune(name, '/') && !strings.HasPrefix(name, ".")
+}
+
+func (c *Client) Stat(name string) (repository.FileInfo, error) {
+	resp, err := c.do(http.MethodHead, c.base.JoinPath(name))
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	_ = resp.Body.Close()
+
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return repository.FileInfo{Name: name, Size: resp.ContentLength, ModTime: mtime}, nil
+}
+
+func (c *Client) Open(name string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, c.base.JoinPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) Put(name string, r io.Reader) error {
+	return fmt.Errorf("upload %s: HTTP repository is read-only: %w", name, errors.ErrUnsupported)
+}
+
+func (c *Client) Create(name string, r io.Reader) error {
+	return c.Put(name, r)
+}
+
+func (c *Client) Delete(name string) error {
+	return fmt.Errorf("delete %s: HTTP repository is read-only: %w", name, errors.ErrUnsupported)
+}
+
+// do sends the request and checks the response status. A missing file is
+// reported with an error matching os.ErrNotExist.
+func (c *Client) do(method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	} else if c.config.User != "" {
+		req.SetBasicAuth(c.config.User, c.config.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return nil, &fs.PathError{Op: method, Path: u.Redacted(), Err: fs.ErrNotExist}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, fmt.Errorf("%s %s: access denied: %s", method, u.Redacted(), resp.Status)
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, u.Redacted(), resp.Status)
+}
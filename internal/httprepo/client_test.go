@@ -0,0 +1,192 @@
+package httprepo
+
+import (
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/alew-moose/pm/internal/repository"
+)
+
+var files = map[string]string{
+	"packet-1.0.0":        "archive",
+	"packet-1.0.0.sha256": "checksum",
+}
+
+const htmlListing = `<html><body><h1>Index of /pm/</h1><pre>
+<a href="../">../</a>
+<a href="?C=N;O=D">Name</a>
+<a href="sub/">sub/</a>
+<a href="packet-1.0.0">packet-1.0.0</a>
+<a href="packet-1.0.0.sha256">packet-1.0.0.sha256</a>
+<a href="packet%2B1.0.0">packet+1.0.0</a>
+<a href=".hidden">.hidden</a>
+<a href="https://example.com/">elsewhere</a>
+</pre></body></html>`
+
+const jsonListing = `[
+{ "name":"sub", "type":"directory", "mtime":"Tue, 02 Jan 2024 03:04:05 GMT" },
+{ "name":"packet-1.0.0", "type":"file", "mtime":"Tue, 02 Jan 2024 03:04:05 GMT", "size":7 },
+{ "name":"packet-1.0.0.sha256", "type":"file", "mtime":"Tue, 02 Jan 2024 03:04:05 GMT", "size":8 }
+]`
+
+// newServer serves files under /pm/ with the listing, requiring the
+// authorization header if it is not empty.
+func newServer(t *testing.T, tls bool, listing, contentType, authorization string) *httptest.Server {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorization != "" && r.Header.Get("Authorization") != authorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/pm/" {
+			w.Header().Set("Content-Type", contentType)
+			_, _ = io.WriteString(w, listing)
+			return
+		}
+		content, ok := files[r.URL.Path[len("/pm/"):]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, content)
+	})
+	var server *httptest.Server
+	if tls {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newClient(t *testing.T, server *httptest.Server, config *Config) *Client {
+	t.Helper()
+	base, err := url.Parse(server.URL + "/pm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(base, config)
+	if err != nil {
+		t.Fatalf("NewClient returned error %q", err)
+	}
+	return client
+}
+
+func names(files []repository.FileInfo) []string {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		listing     string
+		contentType string
+		want        []string
+	}{
+		{
+			listing:     htmlListing,
+			contentType: "text/html",
+			want:        []string{"packet+1.0.0", "packet-1.0.0", "packet-1.0.0.sha256"},
+		},
+		{
+			listing:     jsonListing,
+			contentType: "application/json; charset=utf-8",
+			want:        []string{"packet-1.0.0", "packet-1.0.0.sha256"},
+		},
+	}
+	for ti, tt := range tests {
+		server := newServer(t, false, tt.listing, tt.contentType, "")
+		got, err := newClient(t, server, &Config{}).List()
+		if err != nil {
+			t.Errorf("failed test #%d: List returned error %q", ti, err)
+			continue
+		}
+		if !slices.Equal(names(got), tt.want) {
+			t.Errorf("failed test #%d: List: got %q, want %q", ti, names(got), tt.want)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	server := newServer(t, false, htmlListing, "text/html", "Bearer secret")
+
+	if _, err := newClient(t, server, &Config{}).List(); err == nil {
+		t.Errorf("List without a token returned no error")
+	}
+
+	client := newClient(t, server, &Config{Token: "secret"})
+	b, err := repository.ReadFile(client, "packet-1.0.0")
+	if err != nil || string(b) != "archive" {
+		t.Errorf("ReadFile: got %q, %v", b, err)
+	}
+	fileInfo, err := client.Stat("packet-1.0.0")
+	if err != nil || fileInfo.Size != int64(len("archive")) {
+		t.Errorf("Stat: got %v, %v", fileInfo, err)
+	}
+	if _, err := client.Stat("packet-2.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat of a missing file: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := client.Open("packet-2.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open of a missing file: got %v, want os.ErrNotExist", err)
+	}
+	if err := client.Put("packet-2.0.0", nil); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Put: got %v, want errors.ErrUnsupported", err)
+	}
+
+	basic := newServer(t, false, htmlListing, "text/html", "Basic dXNlcjpwYXNzd29yZA==")
+	if _, err := newClient(t, basic, &Config{User: "user", Password: "password"}).List(); err != nil {
+		t.Errorf("List with basic auth returned error %q", err)
+	}
+}
+
+func TestCAFile(t *testing.T) {
+	server := newServer(t, true, htmlListing, "text/html", "")
+
+	if _, err := newClient(t, server, &Config{}).List(); err == nil {
+		t.Errorf("List with an unknown CA returned no error")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newClient(t, server, &Config{CAFile: caFile}).List(); err != nil {
+		t.Errorf("List with the CA file returned error %q", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		config  Config
+		wantErr bool
+	}{
+		{config: Config{}},
+		{config: Config{User: "user", Password: "password"}},
+		{config: Config{Token: "token"}},
+		{config: Config{User: "user", Token: "token"}, wantErr: true},
+		{config: Config{Password: "password"}, wantErr: true},
+	}
+	for ti, tt := range tests {
+		err := tt.config.Validate()
+		if err != nil && !tt.wantErr {
+			t.Errorf("failed test #%d: Validate returned error %q", ti, err)
+		}
+		if err == nil && tt.wantErr {
+			t.Errorf("failed test #%d: Validate returned no error", ti)
+		}
+	}
+}
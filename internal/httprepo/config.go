@@ -0,0 +1,43 @@
+package httprepo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type Config struct {
+	// User and Password are sent with basic auth, Token as a bearer
+	// token. Both can't be set.
+	User     string `json:"http_user"`
+	Password string `json:"http_password"`
+	Token    string `json:"http_token"`
+	// CAFile is a PEM bundle of certificate authorities trusted in
+	// addition to the system ones.
+	CAFile string `json:"http_ca_file"`
+}
+
+func (c *Config) Validate() error {
+	if c.Token != "" && (c.User != "" || c.Password != "") {
+		return errors.New("both basic auth and bearer token are set")
+	}
+	if c.Password != "" && c.User == "" {
+		return errors.New("password is set, but user is empty")
+	}
+	return nil
+}
+
+func ConfigFromFile(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf Config
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("unmarshal json: %s", err)
+	}
+
+	return &conf, nil
+}
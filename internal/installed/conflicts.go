@@ -0,0 +1,99 @@
+package installed
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/alew-moose/pm/internal/glob"
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+// Conflict is a path of a package being installed which is already taken
+// by another package, or by a file not installed by pm.
+type Conflict struct {
+	Path    string
+	Package pkg.PackageVersion
+	Owner   *pkg.PackageVersion // nil for files not installed by pm
+}
+
+func (c Conflict) String() string {
+	if c.Owner == nil {
+		return fmt.Sprintf("%q of %s already exists and was not installed by pm", c.Path, c.Package)
+	}
+	return fmt.Sprintf("%q of %s is also installed by %s", c.Path, c.Package, c.Owner)
+}
+
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	strs := make([]string, 0, len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		strs = append(strs, c.String())
+	}
+	return fmt.Sprintf("file conflicts: %s", strings.Join(strs, "; "))
+}
+
+// Conflicts returns paths that packages, listed in install order, would
+// take over from other packages or from existing files not installed by
+// pm, unless their Replaces and Overwrite allow it. Previous versions of
+// the packages are not conflicting. exists reports whether a file exists
+// in the install root.
+func (db *DB) Conflicts(packages []Package, exists func(string) bool) []Conflict {
+	installing := make(map[pkg.PackageName]struct{}, len(packages))
+	for _, p := range packages {
+		installing[p.Name] = struct{}{}
+	}
+
+	// files of packages being upgraded are only taken into account to
+	// tell them from files not installed by pm: the new versions may not
+	// have them
+	managed := make(map[string]struct{})
+	owners := make(map[string]pkg.PackageVersion)
+	for _, p := range db.Packages {
+		_, upgraded := installing[p.Name]
+		for _, f := range p.Files {
+			managed[f.Path] = struct{}{}
+			if !upgraded {
+				owners[f.Path] = p.PackageVersion()
+			}
+		}
+	}
+
+	var conflicts []Conflict
+	for _, p := range packages {
+		for _, f := range p.Files {
+			if f.Mode.IsDir() {
+				// directories are shared, and a directory replacing a
+				// file fails on commit
+				continue
+			}
+			owner, owned := owners[f.Path]
+			_, isManaged := managed[f.Path]
+			switch {
+			case owned && !p.mayTakeOver(f.Path, owner.Name):
+				conflicts = append(conflicts, Conflict{Path: f.Path, Package: p.PackageVersion(), Owner: &owner})
+			case !owned && !isManaged && exists(f.Path) && !p.mayTakeOver(f.Path, ""):
+				conflicts = append(conflicts, Conflict{Path: f.Path, Package: p.PackageVersion()})
+			}
+			owners[f.Path] = p.PackageVersion()
+		}
+	}
+	return conflicts
+}
+
+// mayTakeOver reports whether the package may replace the file at path,
+// installed by owner or not installed by pm if owner is empty.
+func (p *Package) mayTakeOver(path string, owner pkg.PackageName) bool {
+	if owner != "" && slices.Contains(p.Replaces, owner) {
+		return true
+	}
+	for _, pattern := range p.Overwrite {
+		if ok, _ := glob.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
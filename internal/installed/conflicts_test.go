@@ -0,0 +1,87 @@
+package installed
+
+import (
+	"testing"
+
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+func TestConflicts(t *testing.T) {
+	withMetadata := func(p Package, replaces []pkg.PackageName, overwrite ...string) Package {
+		p.Replaces = replaces
+		p.Overwrite = overwrite
+		return p
+	}
+
+	db := &DB{}
+	db.Add(testPackage("lib", 1, "lib/a.so", "share/lib.txt"))
+	db.Add(testPackage("tool", 1, "bin/tool", "share/old.txt"))
+	existing := map[string]bool{
+		"lib/a.so":      true,
+		"share/lib.txt": true,
+		"bin/tool":      true,
+		"share/old.txt": true,
+		"etc/local.ini": true,
+	}
+	exists := func(name string) bool {
+		return existing[name]
+	}
+
+	tests := []struct {
+		packages []Package
+		want     []string
+	}{
+		{
+			packages: []Package{testPackage("app", 1, "bin/app")},
+		},
+		{
+			// a new version of an installed package
+			packages: []Package{testPackage("lib", 2, "lib/a.so", "lib/b.so")},
+		},
+		{
+			packages: []Package{testPackage("app", 1, "bin/tool", "etc/local.ini")},
+			want: []string{
+				`"bin/tool" of app-1.0.0 is also installed by tool-1.0.0`,
+				`"etc/local.ini" of app-1.0.0 already exists and was not installed by pm`,
+			},
+		},
+		{
+			packages: []Package{
+				testPackage("app", 1, "bin/app"),
+				testPackage("app2", 1, "bin/app"),
+			},
+			want: []string{`"bin/app" of app2-1.0.0 is also installed by app-1.0.0`},
+		},
+		{
+			packages: []Package{withMetadata(testPackage("tool2", 1, "bin/tool", "share/old.txt"), []pkg.PackageName{"tool"})},
+		},
+		{
+			packages: []Package{withMetadata(testPackage("app", 1, "bin/tool", "etc/local.ini"), nil, "bin/*", "etc/**")},
+		},
+		{
+			// share/old.txt is dropped by the new version of tool
+			packages: []Package{
+				testPackage("tool", 2, "bin/tool"),
+				testPackage("app", 1, "share/old.txt"),
+			},
+		},
+	}
+
+	for ti, tt := range tests {
+		conflicts := db.Conflicts(tt.packages, exists)
+		got := make([]string, 0, len(conflicts))
+		for _, c := range conflicts {
+			got = append(got, c.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("failed test #%d: got %q, want %q", ti, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("failed test #%d: got %q, want %q", ti, got, tt.want)
+				break
+			}
+		}
+	}
+}
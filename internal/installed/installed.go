@@ -0,0 +1,126 @@
+// Package installed keeps track of packages installed into an install
+// root and of the files that belong to them.
+package installed
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+// DBPath is the database location relative to the install root.
+const DBPath = archive.Dir + "/installed.json"
+
+// DB lists installed packages sorted by name. Only one version of a
+// package can be installed.
+type DB struct {
+	Packages []Package `json:"packages"`
+}
+
+// Package is an installed package version. Files are relative to the
+// install root.
+type Package struct {
+	pkg.Metadata
+	SHA256      string         `json:"sha256,omitempty"` // of the archive
+	InstallTime time.Time      `json:"install_time"`
+	Files       []archive.File `json:"files"`
+}
+
+// Load reads the database from the install root. A missing database is
+// empty.
+func Load(root *os.Root) (*DB, error) {
+	b, err := root.ReadFile(DBPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return &DB{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var db DB
+	if err := json.Unmarshal(b, &db); err != nil {
+		return nil, fmt.Errorf("parse %s: %s", DBPath, err)
+	}
+	return &db, nil
+}
+
+func (db *DB) JSON() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(db); err != nil {
+		return nil, fmt.Errorf("marshal json: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Package returns the installed version of the package.
+func (db *DB) Package(name pkg.PackageName) (*Package, bool) {
+	i, ok := db.find(name)
+	if !ok {
+		return nil, false
+	}
+	return &db.Packages[i], true
+}
+
+// Add records the package, replacing the installed version if any. Files
+// of the package, except directories, no longer belong to other packages.
+func (db *DB) Add(p Package) {
+	paths := make(map[string]struct{}, len(p.Files))
+	for _, f := range p.Files {
+		// directories are shared
+		if !f.Mode.IsDir() {
+			paths[f.Path] = struct{}{}
+		}
+	}
+	for i := range db.Packages {
+		// cloned, as callers may keep copies of packages
+		db.Packages[i].Files = slices.DeleteFunc(slices.Clone(db.Packages[i].Files), func(f archive.File) bool {
+			_, ok := paths[f.Path]
+			return ok
+		})
+	}
+
+	i, ok := db.find(p.Name)
+	if ok {
+		db.Packages[i] = p
+		return
+	}
+	db.Packages = slices.Insert(db.Packages, i, p)
+}
+
+// Remove forgets the package.
+func (db *DB) Remove(name pkg.PackageName) {
+	if i, ok := db.find(name); ok {
+		db.Packages = slices.Delete(db.Packages, i, i+1)
+	}
+}
+
+// Owners returns the packages files belong to, keyed by file paths.
+// Directories may belong to several packages, then the first one is kept.
+func (db *DB) Owners() map[string]*Package {
+	owners := make(map[string]*Package)
+	for i := range db.Packages {
+		for _, f := range db.Packages[i].Files {
+			if _, ok := owners[f.Path]; !ok {
+				owners[f.Path] = &db.Packages[i]
+			}
+		}
+	}
+	return owners
+}
+
+func (db *DB) find(name pkg.PackageName) (int, bool) {
+	return slices.BinarySearchFunc(db.Packages, name, func(p Package, name pkg.PackageName) int {
+		return strings.Compare(string(p.Name), string(name))
+	})
+}
@@ -0,0 +1,112 @@
+package installed
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+func testPackage(name string, major uint64, files ...string) Package {
+	p := Package{
+		Metadata: pkg.Metadata{
+			Name:    pkg.PackageName(name),
+			Version: version.Version{Major: major},
+		},
+	}
+	for _, f := range files {
+		p.Files = append(p.Files, archive.File{Path: f, Mode: 0644, SHA256: "00"})
+	}
+	return p
+}
+
+func TestDB(t *testing.T) {
+	var db DB
+	db.Add(testPackage("lib", 1, "lib/a.so"))
+	db.Add(testPackage("app", 1, "bin/app"))
+	db.Add(testPackage("tool", 1, "bin/tool"))
+	db.Add(testPackage("lib", 2, "lib/b.so"))
+
+	var names []pkg.PackageName
+	for _, p := range db.Packages {
+		names = append(names, p.Name)
+	}
+	if want := []pkg.PackageName{"app", "lib", "tool"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("packages: got %v, want %v", names, want)
+	}
+
+	if p, ok := db.Package("lib"); !ok || p.Version.Major != 2 {
+		t.Errorf("Package(lib): got %v, %t, want version 2", p, ok)
+	}
+	owners := db.Owners()
+	if p, ok := owners["lib/b.so"]; !ok || p.Name != "lib" {
+		t.Errorf("owner of lib/b.so: got %v, %t, want lib", p, ok)
+	}
+	if _, ok := owners["lib/a.so"]; ok {
+		t.Errorf("owner of lib/a.so: file of the replaced version is still owned")
+	}
+
+	db.Add(testPackage("tool2", 1, "bin/tool"))
+	if p, ok := db.Owners()["bin/tool"]; !ok || p.Name != "tool2" {
+		t.Errorf("owner of bin/tool: got %v, %t, want tool2", p, ok)
+	}
+	if p, _ := db.Package("tool"); len(p.Files) != 0 {
+		t.Errorf("files taken over by tool2 still belong to tool: %v", p.Files)
+	}
+
+	db.Remove("app")
+	if _, ok := db.Package("app"); ok {
+		t.Errorf("Package(app): removed package is still installed")
+	}
+	if _, ok := db.Package("missing"); ok {
+		t.Errorf("Package(missing): got a package")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	db, err := Load(root)
+	if err != nil {
+		t.Fatalf("Load of a missing database returned error %q", err)
+	}
+	if len(db.Packages) != 0 {
+		t.Fatalf("Load of a missing database: got %d packages", len(db.Packages))
+	}
+
+	db.Add(testPackage("lib", 1, "lib/a.so", "lib/b.so"))
+	saveDB(t, root, db)
+
+	loaded, err := Load(root)
+	if err != nil {
+		t.Fatalf("Load returned error %q", err)
+	}
+	if !reflect.DeepEqual(loaded, db) {
+		t.Errorf("Load: got %+v, want %+v", loaded, db)
+	}
+}
+
+// saveDB writes the database into the install root, as a transaction does.
+func saveDB(t *testing.T, root *os.Root, db *DB) {
+	t.Helper()
+	b, err := db.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.MkdirAll(path.Dir(DBPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.WriteFile(DBPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
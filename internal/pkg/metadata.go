@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/alew-moose/pm/internal/glob"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+// Metadata describes a published package. It is stored next to the
+// package archive, so dependencies can be resolved without downloading
+// archives.
+type Metadata struct {
+	Name         PackageName          `json:"name"`
+	Version      version.Version      `json:"ver"`
+	Dependencies []PackageVersionSpec `json:"packets,omitempty"`
+	// Replaces lists packages whose files the package may take over.
+	Replaces []PackageName `json:"replaces,omitempty"`
+	// Overwrite lists glob patterns of paths the package may take over
+	// from any package or from files not installed by pm.
+	Overwrite []string `json:"overwrite,omitempty"`
+}
+
+func (m Metadata) PackageVersion() PackageVersion {
+	return PackageVersion{Name: m.Name, Version: m.Version}
+}
+
+func (m Metadata) Validate() error {
+	if err := m.PackageVersion().Validate(); err != nil {
+		return err
+	}
+	for _, dep := range m.Dependencies {
+		if err := dep.Validate(); err != nil {
+			return fmt.Errorf("invalid dependency: %s", err)
+		}
+	}
+	for _, name := range m.Replaces {
+		if err := name.Validate(); err != nil {
+			return fmt.Errorf("invalid replaces: %s", err)
+		}
+	}
+	for _, pattern := range m.Overwrite {
+		if err := glob.Validate(pattern); err != nil {
+			return fmt.Errorf("invalid overwrite pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
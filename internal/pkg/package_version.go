@@ -16,6 +16,19 @@ func (pv PackageVersion) String() string {
 	return fmt.Sprintf("%s-%s", pv.Name, pv.Version)
 }
 
+// FileNames returns the names the archive of the package may have in the
+// repository: <name>-<ver>, and for versions without a patch part also
+// <name>-<major>.<minor>, as packages were published before versions had
+// three parts.
+func (pv PackageVersion) FileNames() []string {
+	names := []string{pv.String()}
+	v := pv.Version
+	if v.Patch == 0 && v.PreRelease == "" && v.Build == "" {
+		names = append(names, fmt.Sprintf("%s-%d.%d", pv.Name, v.Major, v.Minor))
+	}
+	return names
+}
+
 func (pv PackageVersion) Validate() error {
 	if err := pv.Name.Validate(); err != nil {
 		return err
@@ -26,7 +39,9 @@ func (pv PackageVersion) Validate() error {
 	return nil
 }
 
-var packageVersionRe = regexp.MustCompile(`^(.+)-(.+)$`)
+// The name is matched lazily so that pre-release versions containing "-"
+// (e.g. "packet-1-2.0.0-rc-1") are not split in the middle.
+var packageVersionRe = regexp.MustCompile(`^(.+?)-(\d+\.\d+.*)$`)
 
 func PackageVersionFromString(s string) (PackageVersion, error) {
 	var packageVersion PackageVersion
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/alew-moose/pm/internal/version"
+)
+
+func TestPackageVersionFromString(t *testing.T) {
+	tests := []struct {
+		str                string
+		wantPackageVersion PackageVersion
+		wantErr            bool
+	}{
+		{str: "", wantErr: true},
+		{str: "packet", wantErr: true},
+		{str: "packet-", wantErr: true},
+		{str: "-1.0", wantErr: true},
+		{str: "packet-1", wantErr: true},
+		{str: "pack et-1.0", wantErr: true},
+		{str: "packet-1.10", wantPackageVersion: PackageVersion{Name: "packet", Version: version.Version{Major: 1, Minor: 10}}},
+		{str: "packet-1-1.10", wantPackageVersion: PackageVersion{Name: "packet-1", Version: version.Version{Major: 1, Minor: 10}}},
+		{str: "packet-1.10.2", wantPackageVersion: PackageVersion{Name: "packet", Version: version.Version{Major: 1, Minor: 10, Patch: 2}}},
+		{
+			str:                "packet-2.0.0-rc-1+build.7",
+			wantPackageVersion: PackageVersion{Name: "packet", Version: version.Version{Major: 2, PreRelease: "rc-1", Build: "build.7"}},
+		},
+	}
+
+	for ti, tt := range tests {
+		packageVersion, err := PackageVersionFromString(tt.str)
+		if err != nil && !tt.wantErr {
+			t.Errorf("failed test #%d: PackageVersionFromString(%q) returned error %q", ti, tt.str, err)
+			continue
+		}
+		if err == nil && tt.wantErr {
+			t.Errorf("failed test #%d: expected error from PackageVersionFromString(%q)", ti, tt.str)
+			continue
+		}
+		if !tt.wantErr && packageVersion != tt.wantPackageVersion {
+			t.Errorf("failed test #%d: PackageVersionFromString(%q): got %#v, want %#v", ti, tt.str, packageVersion, tt.wantPackageVersion)
+		}
+	}
+}
+
+func TestPackageVersionFileNames(t *testing.T) {
+	tests := []struct {
+		str  string
+		want []string
+	}{
+		{str: "packet-1.10", want: []string{"packet-1.10.0", "packet-1.10"}},
+		{str: "packet-1.10.0", want: []string{"packet-1.10.0", "packet-1.10"}},
+		{str: "packet-1.10.2", want: []string{"packet-1.10.2"}},
+		{str: "packet-1.0.0-rc", want: []string{"packet-1.0.0-rc"}},
+		{str: "packet-1.0.0+build", want: []string{"packet-1.0.0+build"}},
+	}
+
+	for ti, tt := range tests {
+		pv, err := PackageVersionFromString(tt.str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pv.FileNames(); !slices.Equal(got, tt.want) {
+			t.Errorf("failed test #%d: FileNames of %q: got %q, want %q", ti, tt.str, got, tt.want)
+		}
+	}
+}
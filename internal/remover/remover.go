@@ -0,0 +1,225 @@
+package remover
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/installed"
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/transaction"
+)
+
+type Config struct {
+	Packages []pkg.PackageName
+	// Prefix is the install root. The current directory is used if it is
+	// empty.
+	Prefix string
+	// Force removes packages other installed packages depend on and files
+	// modified after installation.
+	Force bool
+}
+
+func (c *Config) Validate() error {
+	if len(c.Packages) == 0 {
+		return errors.New("no packages")
+	}
+	for _, name := range c.Packages {
+		if err := name.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type PackageRemover struct {
+	config *Config
+}
+
+func NewPackageRemover(config *Config) (*PackageRemover, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err)
+	}
+	return &PackageRemover{config: config}, nil
+}
+
+func (r *PackageRemover) Remove() error {
+	prefix := r.config.Prefix
+	if prefix == "" {
+		prefix = "."
+	}
+	root, err := os.OpenRoot(prefix)
+	if err != nil {
+		return fmt.Errorf("open install root: %s", err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	// the database may be restored by the recovery
+	if err := transaction.Recover(root); err != nil {
+		return fmt.Errorf("recover interrupted transaction: %s", err)
+	}
+	db, err := installed.Load(root)
+	if err != nil {
+		return fmt.Errorf("load installed packages: %s", err)
+	}
+
+	for _, name := range r.config.Packages {
+		if _, ok := db.Package(name); !ok {
+			return fmt.Errorf("package %s is not installed", name)
+		}
+	}
+
+	if dependents := Dependents(db, r.config.Packages); len(dependents) > 0 {
+		if !r.config.Force {
+			return fmt.Errorf("required by installed packages: %s", strings.Join(dependents, ", "))
+		}
+		log.Printf("removing packages required by installed packages: %s\n", strings.Join(dependents, ", "))
+	}
+
+	txn, err := transaction.Begin(root)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %s", err)
+	}
+	defer func() {
+		_ = txn.Rollback()
+	}()
+
+	for _, name := range r.config.Packages {
+		installedPackage, _ := db.Package(name)
+		p := *installedPackage // db.Remove reuses the memory
+		log.Printf("removing package %s\n", p.PackageVersion())
+		db.Remove(name)
+		removable, err := Removable(root, db, p.Files, r.config.Force)
+		if err != nil {
+			return fmt.Errorf("remove %s: %s", name, err)
+		}
+		for _, name := range removable {
+			if err := txn.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := db.JSON()
+	if err != nil {
+		return fmt.Errorf("save installed packages: %s", err)
+	}
+	if err := txn.WriteFile(installed.DBPath, b, 0644); err != nil {
+		return fmt.Errorf("save installed packages: %s", err)
+	}
+
+	return txn.Commit()
+}
+
+// Dependents describes installed packages, not being removed, that depend
+// on any of the packages, e.g. "app-1.0.0 requires lib".
+func Dependents(db *installed.DB, names []pkg.PackageName) []string {
+	var dependents []string
+	for _, p := range db.Packages {
+		if slices.Contains(names, p.Name) {
+			continue
+		}
+		for _, dep := range p.Dependencies {
+			if slices.Contains(names, dep.Name) {
+				dependents = append(dependents, fmt.Sprintf("%s requires %s", p.PackageVersion(), dep.Name))
+			}
+		}
+	}
+	return dependents
+}
+
+// Removable returns files of a package, which are no longer recorded in
+// the database, that can be removed. Files that belong to other packages
+// or are already removed are skipped, and so are modified files unless
+// forced.
+func Removable(root *os.Root, db *installed.DB, files []archive.File, force bool) ([]string, error) {
+	var removable []string
+	var modified []string
+	owners := db.Owners()
+	for _, f := range files {
+		if owner, ok := owners[f.Path]; ok {
+			log.Printf("%q belongs to %s, keeping\n", f.Path, owner.PackageVersion())
+			continue
+		}
+
+		if f.Mode.IsDir() {
+			// a symbolic link in its place, like lib -> lib64, is not
+			// the package's
+			if fileInfo, err := root.Lstat(f.Path); err == nil && fileInfo.Mode()&fs.ModeSymlink != 0 {
+				log.Printf("%q is a symbolic link now, keeping\n", f.Path)
+				continue
+			}
+			// removed by the transaction if it is empty
+			removable = append(removable, f.Path)
+			continue
+		}
+
+		changed, err := isModified(root, f)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("%q is already removed\n", f.Path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			if !force {
+				log.Printf("%q was modified after installation, keeping\n", f.Path)
+				modified = append(modified, f.Path)
+				continue
+			}
+			log.Printf("%q was modified after installation, removing anyway\n", f.Path)
+		}
+
+		removable = append(removable, f.Path)
+	}
+
+	if len(modified) > 0 {
+		log.Printf("kept files modified after installation: %s\n", strings.Join(modified, ", "))
+	}
+
+	return removable, nil
+}
+
+// isModified reports whether the installed file differs from the one
+// recorded in the manifest.
+func isModified(root *os.Root, f archive.File) (bool, error) {
+	fileInfo, err := root.Lstat(f.Path)
+	if err != nil {
+		return false, err
+	}
+	if fileInfo.Mode().Type() != f.Mode.Type() {
+		return true, nil
+	}
+	if f.Mode&fs.ModeSymlink != 0 {
+		link, err := root.Readlink(f.Path)
+		if err != nil {
+			return false, err
+		}
+		return link != f.Link, nil
+	}
+	sum, err := fileSHA256(root, f.Path)
+	if err != nil {
+		return false, err
+	}
+	return sum != f.SHA256, nil
+}
+
+func fileSHA256(root *os.Root, name string) (string, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return checksum.SHA256(f)
+}
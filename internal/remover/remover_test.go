@@ -0,0 +1,259 @@
+package remover
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/installed"
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/transaction"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+// install creates the files and records them as the package's.
+func install(t *testing.T, root *os.Root, db *installed.DB, p pkg.Metadata, files ...string) {
+	t.Helper()
+	ip := installed.Package{Metadata: p}
+	for _, name := range files {
+		if err := root.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := root.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := checksum.SHA256(strings.NewReader(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip.Files = append(ip.Files, archive.File{Path: name, Mode: 0644, Size: int64(len(name)), SHA256: sum})
+	}
+	db.Add(ip)
+}
+
+func TestRemove(t *testing.T) {
+	dir := t.TempDir()
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	v1 := version.Version{Major: 1}
+	lib := pkg.Metadata{Name: "lib", Version: v1}
+	app := pkg.Metadata{
+		Name:    "app",
+		Version: v1,
+		Dependencies: []pkg.PackageVersionSpec{
+			{Name: "lib", VersionSpec: version.VersionSpec{{}}},
+		},
+	}
+	db := &installed.DB{}
+	install(t, root, db, lib, "lib/a.so", "lib/deep/b.so", "share/lib.txt")
+	install(t, root, db, app, "bin/app", "share/app.txt")
+	saveDB(t, root, db)
+	if err := root.WriteFile("share/lib.txt", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	remove := func(force bool, names ...pkg.PackageName) error {
+		remover, err := NewPackageRemover(&Config{Packages: names, Prefix: dir, Force: force})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return remover.Remove()
+	}
+	exists := func(name string) bool {
+		_, err := root.Lstat(name)
+		return !errors.Is(err, os.ErrNotExist)
+	}
+
+	if err := remove(false, "lib"); err == nil {
+		t.Fatalf("removed lib required by app")
+	}
+	if err := remove(false, "missing"); err == nil {
+		t.Fatalf("removed a package that is not installed")
+	}
+
+	if err := remove(false, "lib", "app"); err != nil {
+		t.Fatalf("remove returned error %q", err)
+	}
+	for _, name := range []string{"lib", "bin", "share/app.txt"} {
+		if exists(name) {
+			t.Errorf("%q was not removed", name)
+		}
+	}
+	if !exists("share/lib.txt") {
+		t.Errorf("modified file was removed")
+	}
+
+	db, err = installed.Load(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Packages) != 0 {
+		t.Errorf("removed packages are still installed: %v", db.Packages)
+	}
+}
+
+func TestRemoveAfterInterruptedUpdate(t *testing.T) {
+	dir := t.TempDir()
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	v1 := version.Version{Major: 1}
+	db := &installed.DB{}
+	install(t, root, db, pkg.Metadata{Name: "lib", Version: v1}, "lib/a.so")
+	saveDB(t, root, db)
+
+	// an update installing app was killed after replacing the database:
+	// the previous one is in the backup, and the journal is not committed
+	for _, name := range []string{transaction.Dir + "/staging", transaction.Dir + "/backup"} {
+		if err := root.MkdirAll(name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Rename(installed.DBPath, transaction.Dir+"/backup/1"); err != nil {
+		t.Fatal(err)
+	}
+	install(t, root, db, pkg.Metadata{Name: "app", Version: v1}, "bin/app")
+	saveDB(t, root, db)
+	journal := `{
+		"committed": false,
+		"ops": [
+			{"path": "bin/app", "staged": ".pm/txn/staging/0", "backup": ".pm/txn/backup/0"},
+			{"path": ".pm/installed.json", "staged": ".pm/txn/staging/1", "backup": ".pm/txn/backup/1"}
+		],
+		"dirs": ["bin"]
+	}`
+	if err := root.WriteFile(transaction.Dir+"/journal.json", []byte(journal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	remover, err := NewPackageRemover(&Config{Packages: []pkg.PackageName{"lib"}, Prefix: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remover.Remove(); err != nil {
+		t.Fatalf("Remove returned error %q", err)
+	}
+
+	// the update is rolled back before lib is removed
+	for _, name := range []string{"lib", "bin", transaction.Dir} {
+		if _, err := root.Lstat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%q exists", name)
+		}
+	}
+	db, err = installed.Load(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Packages) != 0 {
+		t.Errorf("got installed packages %v, want none", db.Packages)
+	}
+}
+
+func TestDependents(t *testing.T) {
+	db := &installed.DB{}
+	db.Add(installed.Package{Metadata: pkg.Metadata{Name: "lib"}})
+	db.Add(installed.Package{Metadata: pkg.Metadata{
+		Name:         "app",
+		Version:      version.Version{Major: 1},
+		Dependencies: []pkg.PackageVersionSpec{{Name: "lib"}},
+	}})
+
+	tests := []struct {
+		names []pkg.PackageName
+		want  int
+	}{
+		{names: []pkg.PackageName{"lib"}, want: 1},
+		{names: []pkg.PackageName{"app"}, want: 0},
+		{names: []pkg.PackageName{"lib", "app"}, want: 0},
+	}
+	for ti, tt := range tests {
+		if got := Dependents(db, tt.names); len(got) != tt.want {
+			t.Errorf("failed test #%d: Dependents(%v): got %q, want %d dependents", ti, tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestRemovable(t *testing.T) {
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	db := &installed.DB{}
+	install(t, root, db, pkg.Metadata{Name: "app"}, "bin/app")
+	for _, link := range []struct{ name, target string }{
+		{"bin/current", "app"},
+		{"bin/moved", "other"},
+		{"bin/replaced", "app"},
+	} {
+		if err := root.Symlink(link.target, link.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Remove("bin/replaced"); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.WriteFile("bin/replaced", []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []archive.File{
+		{Path: "bin", Mode: os.ModeDir | 0755},
+		{Path: "bin/current", Mode: os.ModeSymlink | 0777, Link: "app"},
+		{Path: "bin/moved", Mode: os.ModeSymlink | 0777, Link: "app"},
+		{Path: "bin/replaced", Mode: os.ModeSymlink | 0777, Link: "app"},
+		{Path: "bin/missing", Mode: os.ModeSymlink | 0777, Link: "app"},
+	}
+	tests := []struct {
+		force bool
+		want  []string
+	}{
+		{force: false, want: []string{"bin", "bin/current"}},
+		{force: true, want: []string{"bin", "bin/current", "bin/moved", "bin/replaced"}},
+	}
+	for ti, tt := range tests {
+		got, err := Removable(root, db, files, tt.force)
+		if err != nil {
+			t.Errorf("failed test #%d: Removable returned error %q", ti, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("failed test #%d: Removable: got %q, want %q", ti, got, tt.want)
+		}
+	}
+}
+
+// saveDB writes the database into the install root, as a transaction does.
+func saveDB(t *testing.T, root *os.Root, db *installed.DB) {
+	t.Helper()
+	b, err := db.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.MkdirAll(path.Dir(installed.DBPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.WriteFile(installed.DBPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
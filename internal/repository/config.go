@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+type Config struct {
+	// URL of the repository, e.g. file:///srv/pm-repo or
+	// s3://bucket/prefix. If it is empty, the SFTP server from the config
+	// is used.
+	URL string `json:"repository"`
+	// ReadURL is the repository packages are installed from, if it
+	// differs from the one they are published to, e.g. an HTTPS mirror.
+	ReadURL string `json:"read_repository"`
+}
+
+func ConfigFromFile(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf Config
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("unmarshal json: %s", err)
+	}
+
+	return &conf, nil
+}
+
+// ParseURL parses the repository URL and checks its scheme is supported:
+// file, http, https or s3.
+func ParseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("file URL %q must not have a host", rawURL)
+		}
+		if u.Path == "" || u.Path[0] != '/' {
+			return nil, fmt.Errorf("file URL %q must have an absolute path", rawURL)
+		}
+	case "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%s URL %q has no host", u.Scheme, u.Redacted())
+		}
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("s3 URL %q has no bucket", rawURL)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported repository URL scheme %q", u.Scheme)
+	}
+	return u, nil
+}
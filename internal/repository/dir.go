@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dir is a repository in a local directory, e.g. on an NFS mount. The
+// directory is created on first upload.
+type Dir struct {
+	path string
+}
+
+var _ Repository = (*Dir)(nil)
+
+func NewDir(path string) *Dir {
+	return &Dir{path: path}
+}
+
+// List skips directories and temporary files of unfinished uploads. A
+// missing directory is an empty repository.
+func (d *Dir) List() ([]FileInfo, error) {
+	entries, err := os.ReadDir(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, FileInfo{Name: entry.Name(), Size: fileInfo.Size(), ModTime: fileInfo.ModTime()})
+	}
+	return files, nil
+}
+
+func (d *Dir) Stat(name string) (FileInfo, error) {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+func (d *Dir) Open(name string) (io.ReadCloser, error) {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
+}
+
+// Put writes a temporary file and renames it to name.
+func (d *Dir) Put(name string, r io.Reader) error {
+	return d.write(name, r, os.Rename)
+}
+
+// Create writes a temporary file and hard links it as name, which fails if
+// name exists, also on NFS.
+func (d *Dir) Create(name string, r io.Reader) error {
+	err := d.write(name, r, os.Link)
+	if errors.Is(err, fs.ErrExist) {
+		return &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	}
+	return err
+}
+
+// write writes everything read from r into a temporary file, which is
+// then moved to name by publish.
+func (d *Dir) write(name string, r io.Reader, publish func(oldpath, newpath string) error) error {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.path, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(d.path, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("copy: %s", err)
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close %q: %s", f.Name(), err)
+	}
+
+	return publish(f.Name(), filePath)
+}
+
+func (d *Dir) Delete(name string) error {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+func (d *Dir) filePath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(d.path, name), nil
+}
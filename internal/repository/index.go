@@ -0,0 +1,253 @@
+package repository
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+// IndexName is the file describing all packages of the repository, so
+// they can be resolved with a single read instead of fetching metadata of
+// every version.
+const IndexName = "index.json"
+
+// indexLockName is created exclusively while the index is updated.
+const indexLockName = "index.lock"
+
+// staleIndexLock is the age of a lock left by a crashed pm, after which
+// it is removed.
+const staleIndexLock = 10 * time.Minute
+
+var (
+	indexLockAttempts = 60
+	indexLockDelay    = time.Second
+)
+
+type Index struct {
+	Packages []IndexPackage `json:"packages"`
+}
+
+// IndexPackage is the metadata of a package with the name, the SHA-256
+// digest and the size of its archive.
+type IndexPackage struct {
+	pkg.Metadata
+	// File differs from <name>-<ver> for old packages with two-part
+	// versions.
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// FileName returns the name of the archive in the repository.
+func (p *IndexPackage) FileName() string {
+	if p.File == "" {
+		return p.PackageVersion().String()
+	}
+	return p.File
+}
+
+// Add adds the package, replacing the same version if it is in the
+// index. Packages are kept sorted by name and version.
+func (i *Index) Add(p IndexPackage) {
+	pv := p.PackageVersion()
+	n, found := slices.BinarySearchFunc(i.Packages, pv, func(p IndexPackage, pv pkg.PackageVersion) int {
+		return comparePackageVersions(p.PackageVersion(), pv)
+	})
+	if found {
+		i.Packages[n] = p
+		return
+	}
+	i.Packages = slices.Insert(i.Packages, n, p)
+}
+
+func comparePackageVersions(a, b pkg.PackageVersion) int {
+	return cmp.Or(strings.Compare(string(a.Name), string(b.Name)), a.Version.Compare(b.Version))
+}
+
+func (i *Index) Validate() error {
+	for _, p := range i.Packages {
+		if err := p.Metadata.Validate(); err != nil {
+			return fmt.Errorf("package %s: %s", p.PackageVersion(), err)
+		}
+		if p.SHA256 == "" {
+			return fmt.Errorf("package %s: checksum is empty", p.PackageVersion())
+		}
+		if pv, err := pkg.PackageVersionFromString(p.FileName()); err != nil || pv != p.PackageVersion() {
+			return fmt.Errorf("package %s: file %q is not an archive of it", p.PackageVersion(), p.FileName())
+		}
+	}
+	return nil
+}
+
+// ReadIndex returns an error matching os.ErrNotExist if the repository
+// has no index.
+func ReadIndex(repo Repository) (*Index, error) {
+	b, err := ReadFile(repo, IndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	var index Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("parse index: %s", err)
+	}
+	if err := index.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid index: %s", err)
+	}
+	slices.SortFunc(index.Packages, func(a, b IndexPackage) int {
+		return comparePackageVersions(a.PackageVersion(), b.PackageVersion())
+	})
+
+	return &index, nil
+}
+
+// WriteIndex replaces the index. Concurrent writers must hold the index
+// lock, see UpdateIndex.
+func WriteIndex(repo Repository, index *Index) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // keep version specs like ">=1.0" readable
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(index); err != nil {
+		return fmt.Errorf("marshal index: %s", err)
+	}
+	log.Printf("writing index of %d packages\n", len(index.Packages))
+	return repo.Put(IndexName, &buf)
+}
+
+// UpdateIndex reads the index, missing one being empty, lets update
+// change it and writes it back. The index is locked meanwhile, so
+// concurrent updates don't lose each other's changes.
+func UpdateIndex(repo Repository, update func(*Index) error) error {
+	unlock, err := lockIndex(repo)
+	if err != nil {
+		return fmt.Errorf("lock index: %s", err)
+	}
+	defer unlock()
+
+	index, err := ReadIndex(repo)
+	if errors.Is(err, os.ErrNotExist) {
+		index = &Index{}
+	} else if err != nil {
+		return err
+	}
+
+	if err := update(index); err != nil {
+		return err
+	}
+
+	return WriteIndex(repo, index)
+}
+
+// ReplaceIndex replaces the index under the lock, e.g. with one rebuilt
+// from the archives.
+func ReplaceIndex(repo Repository, build func() (*Index, error)) error {
+	unlock, err := lockIndex(repo)
+	if err != nil {
+		return fmt.Errorf("lock index: %s", err)
+	}
+	defer unlock()
+
+	index, err := build()
+	if err != nil {
+		return err
+	}
+
+	return WriteIndex(repo, index)
+}
+
+// lockIndex creates the lock file, waiting while another pm holds it. A
+// lock older than staleIndexLock is removed.
+func lockIndex(repo Repository) (func(), error) {
+	hostname, _ := os.Hostname()
+	// the time makes every lock differ, so a stale one is told apart from
+	// a lock taken after it was removed
+	owner := fmt.Sprintf("%s %d %s\n", hostname, os.Getpid(), time.Now().UTC().Format(time.RFC3339Nano))
+
+	for attempt := 1; ; attempt++ {
+		err := repo.Create(indexLockName, strings.NewReader(owner))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		lock, fileInfo, err := readLock(repo)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read lock: %s", err)
+		}
+		if !fileInfo.ModTime.IsZero() && time.Since(fileInfo.ModTime) > staleIndexLock {
+			removed, err := removeStaleLock(repo, lock, fileInfo)
+			if err != nil {
+				return nil, fmt.Errorf("remove stale lock: %s", err)
+			}
+			if removed {
+				continue
+			}
+		}
+
+		if attempt == indexLockAttempts {
+			return nil, fmt.Errorf("index is locked, remove %s from the repository if no pm is running", indexLockName)
+		}
+		if attempt == 1 {
+			log.Println("index is locked, waiting")
+		}
+		time.Sleep(indexLockDelay)
+	}
+
+	return func() {
+		if err := repo.Delete(indexLockName); err != nil {
+			log.Printf("remove index lock: %s\n", err)
+		}
+	}, nil
+}
+
+// readLock returns the contents of the lock file and its info.
+func readLock(repo Repository) ([]byte, FileInfo, error) {
+	lock, err := ReadFile(repo, indexLockName)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	fileInfo, err := repo.Stat(indexLockName)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return lock, fileInfo, nil
+}
+
+// removeStaleLock removes the stale lock unless another pm has removed it
+// and taken a lock of its own since it was read: then the lock differs in
+// its contents or modification time.
+func removeStaleLock(repo Repository, stale []byte, staleInfo FileInfo) (bool, error) {
+	lock, fileInfo, err := readLock(repo)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(lock, stale) || !fileInfo.ModTime.Equal(staleInfo.ModTime) {
+		log.Println("stale index lock was replaced by another pm")
+		return false, nil
+	}
+
+	log.Printf("removing stale index lock created at %s\n", staleInfo.ModTime.Format(time.RFC3339))
+	if err := repo.Delete(indexLockName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+func indexPackage(t *testing.T, s, sum string) IndexPackage {
+	t.Helper()
+	pv, err := pkg.PackageVersionFromString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return IndexPackage{Metadata: pkg.Metadata{Name: pv.Name, Version: pv.Version}, SHA256: sum}
+}
+
+func indexNames(index *Index) []string {
+	var names []string
+	for _, p := range index.Packages {
+		names = append(names, p.PackageVersion().String())
+	}
+	return names
+}
+
+func TestIndexAdd(t *testing.T) {
+	tests := []struct {
+		add  []string
+		want []string
+	}{
+		{
+			add:  []string{"b-1.0.0", "a-2.0.0", "a-1.10.0", "a-1.9.0"},
+			want: []string{"a-1.9.0", "a-1.10.0", "a-2.0.0", "b-1.0.0"},
+		},
+		{
+			add:  []string{"a-1.0.0", "a-1.0.0-rc.1", "a-1.0.0"},
+			want: []string{"a-1.0.0-rc.1", "a-1.0.0"},
+		},
+	}
+
+	for i, test := range tests {
+		var index Index
+		for _, s := range test.add {
+			index.Add(indexPackage(t, s, s))
+		}
+		if got := indexNames(&index); !slices.Equal(got, test.want) {
+			t.Errorf("failed test #%d: got %q, want %q", i, got, test.want)
+		}
+	}
+}
+
+func TestUpdateIndex(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testUpdateIndex(t, memRepository{})
+	})
+	t.Run("dir", func(t *testing.T) {
+		testUpdateIndex(t, NewDir(filepath.Join(t.TempDir(), "repo")))
+	})
+}
+
+func testUpdateIndex(t *testing.T, repo Repository) {
+	if _, err := ReadIndex(repo); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ReadIndex of a repository without index: got %v, want os.ErrNotExist", err)
+	}
+
+	for _, s := range []string{"packet-2.0.0", "packet-1.0.0", "packet-2.0.0"} {
+		err := UpdateIndex(repo, func(index *Index) error {
+			index.Add(indexPackage(t, s, "sum of "+s))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("UpdateIndex returned error %q", err)
+		}
+	}
+
+	index, err := ReadIndex(repo)
+	if err != nil {
+		t.Fatalf("ReadIndex returned error %q", err)
+	}
+	if got, want := indexNames(index), []string{"packet-1.0.0", "packet-2.0.0"}; !slices.Equal(got, want) {
+		t.Errorf("index packages: got %q, want %q", got, want)
+	}
+
+	if _, err := repo.Stat(indexLockName); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock after update: got %v, want os.ErrNotExist", err)
+	}
+	names, err := Packages(repo)
+	if err != nil {
+		t.Fatalf("Packages returned error %q", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("Packages: got %q, want none", names)
+	}
+
+	// a held lock makes updates fail once attempts are exhausted
+	defer func(attempts int, delay time.Duration) {
+		indexLockAttempts, indexLockDelay = attempts, delay
+	}(indexLockAttempts, indexLockDelay)
+	indexLockAttempts, indexLockDelay = 2, time.Millisecond
+	if err := repo.Create(indexLockName, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	err = UpdateIndex(repo, func(index *Index) error {
+		t.Error("update called without the lock")
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("UpdateIndex with a held lock: got %v, want lock error", err)
+	}
+}
+
+// staleLockRepository reports the index lock as an hour old. If replaced is
+// set, another pm replaces the lock with a fresh one right after it is
+// first found stale.
+var staleLockTime = time.Now().Add(-time.Hour)
+
+type staleLockRepository struct {
+	memRepository
+	replaced bool
+	stats    int
+}
+
+func (r *staleLockRepository) Stat(name string) (FileInfo, error) {
+	fileInfo, err := r.memRepository.Stat(name)
+	if err != nil || name != indexLockName {
+		return fileInfo, err
+	}
+	r.stats++
+	if r.replaced && r.stats > 1 {
+		return fileInfo, nil
+	}
+	if r.replaced {
+		r.memRepository[indexLockName] = []byte("other pm\n")
+	}
+	fileInfo.ModTime = staleLockTime
+	return fileInfo, nil
+}
+
+func TestStaleIndexLock(t *testing.T) {
+	defer func(attempts int, delay time.Duration) {
+		indexLockAttempts, indexLockDelay = attempts, delay
+	}(indexLockAttempts, indexLockDelay)
+	indexLockAttempts, indexLockDelay = 2, time.Millisecond
+
+	for _, replaced := range []bool{false, true} {
+		repo := &staleLockRepository{memRepository: memRepository{}, replaced: replaced}
+		if err := repo.Create(indexLockName, strings.NewReader("crashed pm\n")); err != nil {
+			t.Fatal(err)
+		}
+		err := UpdateIndex(repo, func(index *Index) error {
+			if replaced {
+				t.Error("update called while another pm holds the lock")
+			}
+			return nil
+		})
+
+		if !replaced {
+			if err != nil {
+				t.Errorf("UpdateIndex with a stale lock returned error %q", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "locked") {
+			t.Errorf("UpdateIndex with a replaced stale lock: got %v, want lock error", err)
+		}
+		if lock := string(repo.memRepository[indexLockName]); lock != "other pm\n" {
+			t.Errorf("lock of another pm: got %q, want it kept", lock)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+// MetadataSuffix is appended to a package name to get the name of the
+// file holding its metadata.
+const MetadataSuffix = ".meta.json"
+
+// ChecksumSuffix is appended to a package name to get the name of the
+// file holding the SHA-256 digest of its archive.
+const ChecksumSuffix = ".sha256"
+
+// SignaturesSuffix is appended to a package name to get the name of the
+// file holding signatures of its archive.
+const SignaturesSuffix = ".sig"
+
+var sidecarSuffixes = []string{MetadataSuffix, ChecksumSuffix, SignaturesSuffix}
+
+func PackageExists(repo Repository, packageName string) (bool, error) {
+	_, err := repo.Stat(packageName)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("stat: %s", err)
+	}
+	return true, nil
+}
+
+// FindPackage returns the name of the archive of the package, or an error
+// matching os.ErrNotExist if there is none. Old packages may have two-part
+// versions in their names.
+func FindPackage(repo Repository, pv pkg.PackageVersion) (string, error) {
+	for _, name := range pv.FileNames() {
+		exists, err := PackageExists(repo, name)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return name, nil
+		}
+	}
+	return "", &fs.PathError{Op: "find", Path: pv.String(), Err: fs.ErrNotExist}
+}
+
+// Packages returns names of package archives, skipping metadata, checksum
+// and signature files and the index.
+func Packages(repo Repository) ([]string, error) {
+	files, err := repo.List()
+	if err != nil {
+		return nil, err
+	}
+	packages := make([]string, 0, len(files))
+	for _, file := range files {
+		if isSidecar(file.Name) || file.Name == IndexName || file.Name == indexLockName {
+			continue
+		}
+		packages = append(packages, file.Name)
+	}
+	return packages, nil
+}
+
+func isSidecar(name string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadPackageChecksum uploads the SHA-256 digest of the package archive
+// before the archive itself, so a visible package always has it. It
+// returns an error matching fs.ErrExist if the package already has one.
+func UploadPackageChecksum(repo Repository, packageName, sum string) error {
+	log.Printf("uploading checksum of package %s: %s\n", packageName, sum)
+	return repo.Create(packageName+ChecksumSuffix, strings.NewReader(checksum.Format(sum, packageName)))
+}
+
+// UploadPackage uploads the archive. It returns an error matching
+// fs.ErrExist if the package exists.
+func UploadPackage(repo Repository, packageName string, archivePath string) error {
+	log.Printf("uploading %q as package %s\n", archivePath, packageName)
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return repo.Create(packageName, f)
+}
+
+// DownloadPackage downloads the package archive into a temporary file and
+// returns its path.
+func DownloadPackage(repo Repository, packageName string) (string, error) {
+	src, err := repo.Open(packageName)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	tmpFilePattern := fmt.Sprintf("%s-*", packageName)
+	dstFile, err := os.CreateTemp("", tmpFilePattern)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = dstFile.Close()
+	}()
+
+	log.Printf("downloading package %s to %q\n", packageName, dstFile.Name())
+
+	if _, err := io.Copy(dstFile, src); err != nil {
+		_ = os.Remove(dstFile.Name())
+		return "", fmt.Errorf("copy: %s", err)
+	}
+
+	if err := dstFile.Close(); err != nil {
+		_ = os.Remove(dstFile.Name())
+		return "", fmt.Errorf("close %q: %s", dstFile.Name(), err)
+	}
+
+	return dstFile.Name(), nil
+}
+
+func UploadPackageMetadata(repo Repository, packageName string, metadata []byte) error {
+	log.Printf("uploading metadata of package %s\n", packageName)
+	return repo.Put(packageName+MetadataSuffix, bytes.NewReader(metadata))
+}
+
+// DownloadPackageMetadata returns an error matching os.ErrNotExist if the
+// package has no metadata.
+func DownloadPackageMetadata(repo Repository, packageName string) ([]byte, error) {
+	return ReadFile(repo, packageName+MetadataSuffix)
+}
+
+// DownloadPackageChecksum returns the hex encoded SHA-256 digest of the
+// package archive, or an error matching os.ErrNotExist if the package has
+// no checksum.
+func DownloadPackageChecksum(repo Repository, packageName string) (string, error) {
+	b, err := ReadFile(repo, packageName+ChecksumSuffix)
+	if err != nil {
+		return "", err
+	}
+	return checksum.Parse(string(b), packageName)
+}
+
+func UploadPackageSignatures(repo Repository, packageName string, signatures []byte) error {
+	log.Printf("uploading signatures of package %s\n", packageName)
+	return repo.Put(packageName+SignaturesSuffix, bytes.NewReader(signatures))
+}
+
+// DownloadPackageSignatures returns an error matching os.ErrNotExist if
+// the package is not signed.
+func DownloadPackageSignatures(repo Repository, packageName string) ([]byte, error) {
+	return ReadFile(repo, packageName+SignaturesSuffix)
+}
+
+// ReadFile returns contents of the file name.
+func ReadFile(repo Repository, name string) ([]byte, error) {
+	r, err := repo.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read: %s", err)
+	}
+
+	return b, nil
+}
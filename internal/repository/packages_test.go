@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+// memRepository keeps files in memory.
+type memRepository map[string][]byte
+
+func (m memRepository) List() ([]FileInfo, error) {
+	files := make([]FileInfo, 0, len(m))
+	for name, b := range m {
+		files = append(files, FileInfo{Name: name, Size: int64(len(b))})
+	}
+	return files, nil
+}
+
+func (m memRepository) Stat(name string) (FileInfo, error) {
+	b, ok := m[name]
+	if !ok {
+		return FileInfo{}, fs.ErrNotExist
+	}
+	return FileInfo{Name: name, Size: int64(len(b)), ModTime: time.Now()}, nil
+}
+
+func (m memRepository) Open(name string) (io.ReadCloser, error) {
+	b, ok := m[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m memRepository) Put(name string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m[name] = b
+	return nil
+}
+
+func (m memRepository) Create(name string, r io.Reader) error {
+	if _, ok := m[name]; ok {
+		return fs.ErrExist
+	}
+	return m.Put(name, r)
+}
+
+func (m memRepository) Delete(name string) error {
+	if _, ok := m[name]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(m, name)
+	return nil
+}
+
+func TestPackages(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testPackages(t, memRepository{})
+	})
+	t.Run("dir", func(t *testing.T) {
+		testPackages(t, NewDir(filepath.Join(t.TempDir(), "repo")))
+	})
+}
+
+func testPackages(t *testing.T, repo Repository) {
+	archivePath := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(archivePath, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, err := PackageExists(repo, "packet-1.0.0"); err != nil || exists {
+		t.Fatalf("PackageExists of a missing package: got %t, %v", exists, err)
+	}
+	sum, err := checksum.FileSHA256(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UploadPackageChecksum(repo, "packet-1.0.0", sum); err != nil {
+		t.Fatalf("UploadPackageChecksum returned error %q", err)
+	}
+	if err := UploadPackageChecksum(repo, "packet-1.0.0", sum); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("second UploadPackageChecksum: got %v, want fs.ErrExist", err)
+	}
+	if err := UploadPackage(repo, "packet-1.0.0", archivePath); err != nil {
+		t.Fatalf("UploadPackage returned error %q", err)
+	}
+	if err := UploadPackage(repo, "packet-1.0.0", archivePath); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("second UploadPackage: got %v, want fs.ErrExist", err)
+	}
+	if err := UploadPackageMetadata(repo, "packet-1.0.0", []byte("{}")); err != nil {
+		t.Fatalf("UploadPackageMetadata returned error %q", err)
+	}
+	if exists, err := PackageExists(repo, "packet-1.0.0"); err != nil || !exists {
+		t.Fatalf("PackageExists of an uploaded package: got %t, %v", exists, err)
+	}
+
+	names, err := Packages(repo)
+	if err != nil {
+		t.Fatalf("Packages returned error %q", err)
+	}
+	if want := []string{"packet-1.0.0"}; !slices.Equal(names, want) {
+		t.Errorf("Packages: got %q, want %q", names, want)
+	}
+
+	published, err := DownloadPackageChecksum(repo, "packet-1.0.0")
+	if err != nil {
+		t.Fatalf("DownloadPackageChecksum returned error %q", err)
+	}
+	if published != sum {
+		t.Errorf("DownloadPackageChecksum: got %q, want %q", published, sum)
+	}
+
+	downloaded, err := DownloadPackage(repo, "packet-1.0.0")
+	if err != nil {
+		t.Fatalf("DownloadPackage returned error %q", err)
+	}
+	defer func() {
+		_ = os.Remove(downloaded)
+	}()
+	if b, err := os.ReadFile(downloaded); err != nil || string(b) != "archive" {
+		t.Errorf("downloaded archive: got %q, %v", b, err)
+	}
+
+	if _, err := DownloadPackageSignatures(repo, "packet-1.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("DownloadPackageSignatures of an unsigned package: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := DownloadPackage(repo, "packet-2.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("DownloadPackage of a missing package: got %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestFindPackage(t *testing.T) {
+	repo := memRepository{
+		"old-1.10":     []byte("archive"),
+		"new-1.10.0":   []byte("archive"),
+		"pre-1.0.0-rc": []byte("archive"),
+	}
+	tests := []struct {
+		pv   string
+		want string
+	}{
+		{pv: "old-1.10.0", want: "old-1.10"},
+		{pv: "new-1.10.0", want: "new-1.10.0"},
+		{pv: "pre-1.0.0-rc", want: "pre-1.0.0-rc"},
+		{pv: "old-1.10.1"},
+		{pv: "pre-1.0.0"},
+	}
+
+	for i, test := range tests {
+		pv, err := pkg.PackageVersionFromString(test.pv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := FindPackage(repo, pv)
+		if test.want == "" {
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("failed test #%d: got %q, %v, want os.ErrNotExist", i, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("failed test #%d: got %q, %v, want %q", i, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Package repository defines the storage packages are published to. A
+// repository is a flat set of files: package archives named
+// <name>-<version> and sidecar files next to them.
+package repository
+
+import (
+	"io"
+	"time"
+)
+
+// Repository is a storage backend. Methods return errors matching
+// os.ErrNotExist for missing files.
+type Repository interface {
+	// List returns all files, in no particular order.
+	List() ([]FileInfo, error)
+	Stat(name string) (FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	// Put creates or replaces the file with everything read from r.
+	// Readers never see a partially written file.
+	Put(name string, r io.Reader) error
+	// Create is like Put, but only creates a new file. If the file exists,
+	// it returns an error matching fs.ErrExist.
+	Create(name string, r io.Reader) error
+	Delete(name string) error
+}
+
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
@@ -0,0 +1,277 @@
+package resolver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/alew-moose/pm/internal/pkg"
+)
+
+// Source provides available packages and their dependencies.
+type Source interface {
+	// Versions returns available versions of the package, greatest first.
+	Versions(name pkg.PackageName) []pkg.PackageVersion
+	Dependencies(pv pkg.PackageVersion) ([]pkg.PackageVersionSpec, error)
+}
+
+// Requirement is a version spec together with the package that declared
+// it. RequiredBy is nil for requested packages.
+type Requirement struct {
+	Spec       pkg.PackageVersionSpec
+	RequiredBy *pkg.PackageVersion
+}
+
+func (r Requirement) String() string {
+	requiredBy := "request"
+	if r.RequiredBy != nil {
+		requiredBy = r.RequiredBy.String()
+	}
+	return fmt.Sprintf("%s requires %s %s", requiredBy, r.Spec.Name, r.Spec.VersionSpec)
+}
+
+// ConflictError explains why no version of a package can be selected.
+type ConflictError struct {
+	Name         pkg.PackageName
+	Requirements []Requirement
+	Available    []pkg.PackageVersion
+}
+
+func (e *ConflictError) Error() string {
+	reqs := make([]string, 0, len(e.Requirements))
+	for _, req := range e.Requirements {
+		reqs = append(reqs, req.String())
+	}
+	if len(e.Requirements) > 1 {
+		return fmt.Sprintf("conflicting requirements for %s: %s", e.Name, strings.Join(reqs, ", "))
+	}
+	if len(e.Available) == 0 {
+		return fmt.Sprintf("%s, but package %s not found", strings.Join(reqs, ", "), e.Name)
+	}
+	versions := make([]string, 0, len(e.Available))
+	for _, pv := range e.Available {
+		versions = append(versions, pv.Version.String())
+	}
+	return fmt.Sprintf("%s, but no such version found (available: %s)", strings.Join(reqs, ", "), strings.Join(versions, ", "))
+}
+
+// Resolve selects exactly one version of every requested package and of
+// all their dependencies, so that every requirement is satisfied. Greater
+// versions are preferred, and earlier decisions are revisited when they
+// lead to a conflict. Packages are returned in dependency order: every
+// package comes after the packages it depends on.
+func Resolve(source Source, specs []pkg.PackageVersionSpec) ([]pkg.PackageVersion, error) {
+	r := &resolver{
+		source:       source,
+		selected:     make(map[pkg.PackageName]pkg.PackageVersion),
+		dependencies: make(map[pkg.PackageVersion][]pkg.PackageVersionSpec),
+	}
+	for _, spec := range specs {
+		r.requirements = append(r.requirements, Requirement{Spec: spec})
+	}
+
+	ok, err := r.solve(0)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, r.conflict
+	}
+
+	return r.order(), nil
+}
+
+type resolver struct {
+	source Source
+
+	// requirements and decisions are stacks, truncated on backtracking
+	requirements []Requirement
+	decisions    []pkg.PackageVersion
+	selected     map[pkg.PackageName]pkg.PackageVersion
+
+	dependencies map[pkg.PackageVersion][]pkg.PackageVersionSpec
+
+	// conflict found at the greatest depth, reported if there is no solution
+	conflict      *ConflictError
+	conflictDepth int
+}
+
+func (r *resolver) solve(depth int) (bool, error) {
+	name, ok := r.nextUndecided()
+	if !ok {
+		return true, nil
+	}
+
+	reqs := r.requirementsFor(name)
+	candidates := r.candidates(name, reqs)
+	if len(candidates) == 0 {
+		r.recordConflict(name, reqs, depth)
+		return false, nil
+	}
+
+	for _, pv := range candidates {
+		deps, err := r.dependenciesOf(pv)
+		if err != nil {
+			return false, err
+		}
+
+		reqsLen := len(r.requirements)
+		r.selected[name] = pv
+		r.decisions = append(r.decisions, pv)
+		for _, dep := range deps {
+			r.requirements = append(r.requirements, Requirement{Spec: dep, RequiredBy: &pv})
+		}
+
+		if r.consistent(depth) {
+			ok, err := r.solve(depth + 1)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+
+		log.Printf("backtracking from %s\n", pv)
+		delete(r.selected, name)
+		r.decisions = r.decisions[:len(r.decisions)-1]
+		r.requirements = r.requirements[:reqsLen]
+	}
+
+	return false, nil
+}
+
+// nextUndecided returns the first required package without a selected
+// version.
+func (r *resolver) nextUndecided() (pkg.PackageName, bool) {
+	for _, req := range r.requirements {
+		if _, ok := r.selected[req.Spec.Name]; !ok {
+			return req.Spec.Name, true
+		}
+	}
+	return "", false
+}
+
+func (r *resolver) requirementsFor(name pkg.PackageName) []Requirement {
+	var reqs []Requirement
+	for _, req := range r.requirements {
+		if req.Spec.Name == name {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+func (r *resolver) candidates(name pkg.PackageName, reqs []Requirement) []pkg.PackageVersion {
+	var candidates []pkg.PackageVersion
+	for _, pv := range r.source.Versions(name) {
+		if matchAll(reqs, pv) {
+			candidates = append(candidates, pv)
+		}
+	}
+	return candidates
+}
+
+func matchAll(reqs []Requirement, pv pkg.PackageVersion) bool {
+	for _, req := range reqs {
+		if !req.Spec.Match(pv) {
+			return false
+		}
+	}
+	return true
+}
+
+// consistent checks that already selected packages satisfy requirements
+// added by the last decision.
+func (r *resolver) consistent(depth int) bool {
+	for _, pv := range r.decisions {
+		reqs := r.requirementsFor(pv.Name)
+		if !matchAll(reqs, pv) {
+			r.recordConflict(pv.Name, reqs, depth)
+			return false
+		}
+	}
+	return true
+}
+
+func (r *resolver) recordConflict(name pkg.PackageName, reqs []Requirement, depth int) {
+	if r.conflict != nil && depth < r.conflictDepth {
+		return
+	}
+	available := r.source.Versions(name)
+	r.conflict = &ConflictError{
+		Name:         name,
+		Requirements: minimalConflict(reqs, available),
+		Available:    available,
+	}
+	r.conflictDepth = depth
+}
+
+// minimalConflict returns a single requirement or a pair of requirements
+// that no available version satisfies, falling back to all of them.
+func minimalConflict(reqs []Requirement, available []pkg.PackageVersion) []Requirement {
+	satisfiable := func(reqs ...Requirement) bool {
+		for _, pv := range available {
+			if matchAll(reqs, pv) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, req := range reqs {
+		if !satisfiable(req) {
+			return []Requirement{req}
+		}
+	}
+	for i := range reqs {
+		for j := i + 1; j < len(reqs); j++ {
+			if !satisfiable(reqs[i], reqs[j]) {
+				return []Requirement{reqs[i], reqs[j]}
+			}
+		}
+	}
+	return reqs
+}
+
+func (r *resolver) dependenciesOf(pv pkg.PackageVersion) ([]pkg.PackageVersionSpec, error) {
+	if deps, ok := r.dependencies[pv]; ok {
+		return deps, nil
+	}
+	deps, err := r.source.Dependencies(pv)
+	if err != nil {
+		return nil, err
+	}
+	r.dependencies[pv] = deps
+	return deps, nil
+}
+
+// order sorts selected packages so that dependencies come first. Cycles
+// are broken at the package first reached again.
+func (r *resolver) order() []pkg.PackageVersion {
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[pkg.PackageName]int)
+	order := make([]pkg.PackageVersion, 0, len(r.decisions))
+
+	var visit func(pv pkg.PackageVersion)
+	visit = func(pv pkg.PackageVersion) {
+		switch state[pv.Name] {
+		case done:
+			return
+		case visiting:
+			log.Printf("dependency cycle through %s\n", pv)
+			return
+		}
+		state[pv.Name] = visiting
+		for _, dep := range r.dependencies[pv] {
+			visit(r.selected[dep.Name])
+		}
+		state[pv.Name] = done
+		order = append(order, pv)
+	}
+
+	for _, pv := range r.decisions {
+		visit(pv)
+	}
+
+	return order
+}
@@ -0,0 +1,171 @@
+package resolver
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+// fakeSource maps "name-version" to dependency specs like "lib >=1.0".
+type fakeSource map[string][]string
+
+func (s fakeSource) Versions(name pkg.PackageName) []pkg.PackageVersion {
+	var pvs []pkg.PackageVersion
+	for str := range s {
+		pv, err := pkg.PackageVersionFromString(str)
+		if err != nil {
+			panic(err)
+		}
+		if pv.Name == name {
+			pvs = append(pvs, pv)
+		}
+	}
+	slices.SortFunc(pvs, func(a, b pkg.PackageVersion) int {
+		return b.Version.Compare(a.Version)
+	})
+	return pvs
+}
+
+func (s fakeSource) Dependencies(pv pkg.PackageVersion) ([]pkg.PackageVersionSpec, error) {
+	var deps []pkg.PackageVersionSpec
+	for _, str := range s[pv.String()] {
+		deps = append(deps, mustSpec(str))
+	}
+	return deps, nil
+}
+
+func mustSpec(s string) pkg.PackageVersionSpec {
+	name, versionSpecStr, _ := strings.Cut(s, " ")
+	versionSpec, err := version.VersionSpecFromString(versionSpecStr)
+	if err != nil {
+		panic(err)
+	}
+	return pkg.PackageVersionSpec{Name: pkg.PackageName(name), VersionSpec: versionSpec}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  fakeSource
+		request []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "greatest versions and dependency order",
+			source: fakeSource{
+				"app-1.0.0":  {"lib >=1.0"},
+				"app-2.0.0":  {"lib >=1.0", "util *"},
+				"lib-1.0.0":  {"util ^1.0"},
+				"lib-1.5.0":  {"util ^1.0"},
+				"util-1.0.0": nil,
+				"util-1.1.0": nil,
+			},
+			request: []string{"app *"},
+			want:    []string{"util-1.1.0", "lib-1.5.0", "app-2.0.0"},
+		},
+		{
+			name: "backtracking",
+			source: fakeSource{
+				"app-1.0.0":  {"lib <2.0"},
+				"app-2.0.0":  {"lib >=2.0"},
+				"tool-1.0.0": {"lib ^1.0"},
+				"lib-1.2.0":  nil,
+				"lib-2.1.0":  nil,
+			},
+			request: []string{"app *", "tool *"},
+			want:    []string{"lib-1.2.0", "app-1.0.0", "tool-1.0.0"},
+		},
+		{
+			name: "backtracking on an already selected package",
+			source: fakeSource{
+				"app-1.0.0":  {"tool *"},
+				"lib-1.0.0":  nil,
+				"lib-2.0.0":  nil,
+				"tool-1.0.0": {"lib <2.0"},
+			},
+			request: []string{"lib *", "app *"},
+			want:    []string{"lib-1.0.0", "tool-1.0.0", "app-1.0.0"},
+		},
+		{
+			name: "several requested specs for one package",
+			source: fakeSource{
+				"lib-1.0.0": nil,
+				"lib-1.5.0": nil,
+				"lib-2.0.0": nil,
+			},
+			request: []string{"lib >=1.0", "lib <2.0"},
+			want:    []string{"lib-1.5.0"},
+		},
+		{
+			name: "cycle",
+			source: fakeSource{
+				"a-1.0.0": {"b *"},
+				"b-1.0.0": {"a *"},
+			},
+			request: []string{"a *"},
+			want:    []string{"b-1.0.0", "a-1.0.0"},
+		},
+		{
+			name: "conflict",
+			source: fakeSource{
+				"app-1.0.0":  {"lib >=2.0"},
+				"tool-1.0.0": {"lib <2.0"},
+				"lib-1.0.0":  nil,
+				"lib-2.0.0":  nil,
+			},
+			request: []string{"app *", "tool *"},
+			wantErr: "conflicting requirements for lib: app-1.0.0 requires lib >=2.0.0, tool-1.0.0 requires lib <2.0.0",
+		},
+		{
+			name: "missing version",
+			source: fakeSource{
+				"app-1.0.0": {"lib >=3.0"},
+				"lib-1.0.0": nil,
+				"lib-2.0.0": nil,
+			},
+			request: []string{"app *"},
+			wantErr: "app-1.0.0 requires lib >=3.0.0, but no such version found (available: 2.0.0, 1.0.0)",
+		},
+		{
+			name:    "missing package",
+			source:  fakeSource{},
+			request: []string{"app >=1.0"},
+			wantErr: "request requires app >=1.0.0, but package app not found",
+		},
+	}
+
+	for _, tt := range tests {
+		var request []pkg.PackageVersionSpec
+		for _, s := range tt.request {
+			request = append(request, mustSpec(s))
+		}
+
+		packages, err := Resolve(tt.source, request)
+		if tt.wantErr != "" {
+			var conflictErr *ConflictError
+			if !errors.As(err, &conflictErr) {
+				t.Errorf("%s: expected ConflictError, got %v", tt.name, err)
+			} else if err.Error() != tt.wantErr {
+				t.Errorf("%s: got error %q, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Resolve returned error %q", tt.name, err)
+			continue
+		}
+
+		got := make([]string, 0, len(packages))
+		for _, pv := range packages {
+			got = append(got, pv.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Package s3repo implements a repository in a bucket of AWS S3 or an
+// S3-compatible service, e.g. MinIO.
+package s3repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alew-moose/pm/internal/repository"
+)
+
+// Client keeps files as objects <prefix>/<name> in the bucket.
+type Client struct {
+	bucket string
+	prefix string
+	// endpoint is the URL of the bucket, objects are under its path
+	endpoint *url.URL
+	config   *Config
+	client   *http.Client
+}
+
+var _ repository.Repository = (*Client)(nil)
+
+// NewClient returns a client of the repository at s3://<bucket>/<prefix>.
+func NewClient(u *url.URL, config *Config) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("validate config: %s", err)
+	}
+
+	c := &Client{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		config: config,
+		client: &http.Client{},
+	}
+	if config.Endpoint == "" {
+		c.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", c.bucket, config.Region), Path: "/"}
+	} else {
+		endpoint, err := url.Parse(config.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint: %s", err)
+		}
+		if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q", config.Endpoint)
+		}
+		c.endpoint = endpoint.JoinPath(c.bucket, "/")
+	}
+	return c, nil
+}
+
+func (c *Client) key(name string) string {
+	if c.prefix == "" {
+		return name
+	}
+	return c.prefix + "/" + name
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List skips objects in "subdirectories" of the prefix and hidden ones.
+func (c *Client) List() ([]repository.FileInfo, error) {
+	prefix := c.key("")
+	var files []repository.FileInfo
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		resp, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse listing: %s", err)
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if name == "" || strings.ContainsRune(name, '/') || strings.HasPrefix(name, ".") {
+				continue
+			}
+			files = append(files, repository.FileInfo{Name: name, Size: object.Size, ModTime: object.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (c *Client) Stat(name string) (repository.FileInfo, error) {
+	resp, err := c.do(http.MethodHead, c.key(name), nil, nil, nil)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	_ = resp.Body.Close()
+
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return repository.FileInfo{Name: name, Size: resp.ContentLength, ModTime: mtime}, nil
+}
+
+func (c *Client) Open(name string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, c.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put uploads the object in one request, objects are visible only once
+// they are complete.
+func (c *Client) Put(name string, r io.Reader) error {
+	return c.put(name, r, nil)
+}
+
+// Create uploads the object with "If-None-Match: *", so S3 rejects it if
+// the object exists.
+func (c *Client) Create(name string, r io.Reader) error {
+	return c.put(name, r, http.Header{"If-None-Match": {"*"}})
+}
+
+func (c *Client) put(name string, r io.Reader, header http.Header) error {
+	body, err := newBody(r)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPut, c.key(name), nil, header, body)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// Delete checks the object exists first, as S3 doesn't report deleting
+// missing objects.
+func (c *Client) Delete(name string) error {
+	if _, err := c.Stat(name); err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodDelete, c.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// body is a request body with a known size and digest.
+type body struct {
+	r      io.ReadSeeker
+	size   int64
+	sha256 string
+}
+
+// newBody hashes the contents of r. Files and other seekable readers are
+// read twice, others are buffered in memory.
+func newBody(r io.Reader) (*body, error) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		rs = bytes.NewReader(b)
+	}
+
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, rs)
+	if err != nil {
+		return nil, fmt.Errorf("read: %s", err)
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &body{r: rs, size: size, sha256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// do sends a signed request for the object key, or for the bucket if key
+// is empty, and checks the response status. A missing object is reported
+// with an error matching fs.ErrNotExist, a failed "If-None-Match" with
+// one matching fs.ErrExist.
+func (c *Client) do(method, key string, query url.Values, header http.Header, body *body) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path += key
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := emptySHA256
+	if body != nil {
+		req.Body = http.NoBody
+		if body.size > 0 {
+			req.Body = io.NopCloser(body.r)
+			req.ContentLength = body.size
+		}
+		payloadHash = body.sha256
+	}
+	sign(req, c.config, payloadHash, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	object := "s3://" + c.bucket + "/" + key
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, &fs.PathError{Op: method, Path: object, Err: fs.ErrNotExist}
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// 409 is returned to a conditional write racing with another one
+		return nil, &fs.PathError{Op: method, Path: object, Err: fs.ErrExist}
+	}
+	return nil, fmt.Errorf("%s %s: %s%s", method, object, resp.Status, errorMessage(resp.Body))
+}
+
+// errorMessage returns the message of an S3 error response, if any.
+func errorMessage(r io.Reader) string {
+	var s3Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r, 64<<10)).Decode(&s3Error); err != nil || s3Error.Code == "" {
+		return ""
+	}
+	return fmt.Sprintf(": %s: %s", s3Error.Code, s3Error.Message)
+}
@@ -0,0 +1,62 @@
+package s3repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type Config struct {
+	// Endpoint is the URL of an S3-compatible service, e.g.
+	// http://localhost:9000 for MinIO. Buckets are addressed by path then.
+	// AWS is used if it is empty.
+	Endpoint string `json:"s3_endpoint"`
+	Region   string `json:"s3_region"`
+	// AccessKey and SecretKey default to AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY.
+	AccessKey string `json:"s3_access_key"`
+	SecretKey string `json:"s3_secret_key"`
+	// SessionToken is taken from AWS_SESSION_TOKEN.
+	SessionToken string `json:"-"`
+}
+
+const defaultRegion = "us-east-1"
+
+func (c *Config) Validate() error {
+	if c.AccessKey == "" {
+		return errors.New("access key is empty")
+	}
+	if c.SecretKey == "" {
+		return errors.New("secret key is empty")
+	}
+	return nil
+}
+
+// ConfigFromFile reads the config, filling missing settings from the
+// standard AWS environment variables.
+func ConfigFromFile(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf Config
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("unmarshal json: %s", err)
+	}
+
+	if conf.Region == "" {
+		conf.Region = os.Getenv("AWS_REGION")
+	}
+	if conf.Region == "" {
+		conf.Region = defaultRegion
+	}
+	if conf.AccessKey == "" && conf.SecretKey == "" {
+		conf.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		conf.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		conf.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	return &conf, nil
+}
@@ -4,25 +4,40 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math/rand/v2"
 	"net"
 	"os"
+	"strings"
 
+	"github.com/alew-moose/pm/internal/repository"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+// Client is a repository in a directory of an SFTP server. It connects on
+// first use, so commands which don't need the repository don't dial.
 type Client struct {
 	client *sftp.Client
 	config *Config
 }
 
+var _ repository.Repository = (*Client)(nil)
+
 func NewClient(config *Config) (*Client, error) {
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("validate config: %s", err)
 	}
-	sshClient, err := sshConnect(config.Host, config.Port, config.User)
+	return &Client{config: config}, nil
+}
+
+func (c *Client) connect() (*sftp.Client, error) {
+	if c.client != nil {
+		return c.client, nil
+	}
+	sshClient, err := sshConnect(c.config.Host, c.config.Port, c.config.User)
 	if err != nil {
 		return nil, fmt.Errorf("ssh connect: %s", err)
 	}
@@ -30,121 +45,130 @@ func NewClient(config *Config) (*Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("new sftp client: %s", err)
 	}
-	client := &Client{
-		client: sftpClient,
-		config: config,
-	}
-	if err := client.CreatePackagesDirUnlessExists(); err != nil {
+	if err := sftpClient.MkdirAll(c.config.Path); err != nil {
 		return nil, fmt.Errorf("create packages dir: %s", err)
 	}
-	packagesDir, err := client.PackagesDir()
+	workingDir, err := sftpClient.Getwd()
 	if err != nil {
 		return nil, fmt.Errorf("get packages dir: %s", err)
 	}
-	log.Printf("packages dir: %s\n", packagesDir)
-	return client, nil
+	log.Printf("packages dir: %s/%s\n", workingDir, c.config.Path)
+	c.client = sftpClient
+	return sftpClient, nil
 }
 
-func (c *Client) CreatePackagesDirUnlessExists() error {
-	return c.client.MkdirAll(c.config.Path)
-}
-
-func (c *Client) PackageExists(name string) (bool, error) {
-	path := fmt.Sprintf("%s/%s", c.config.Path, name)
-	_, err := c.client.Stat(path)
-	if errors.Is(err, os.ErrNotExist) {
-		return false, nil
+// List skips directories and temporary files of unfinished uploads.
+func (c *Client) List() ([]repository.FileInfo, error) {
+	client, err := c.connect()
+	if err != nil {
+		return nil, err
 	}
+	entries, err := client.ReadDir(c.config.Path)
 	if err != nil {
-		return false, fmt.Errorf("stat: %s", err)
+		return nil, err
 	}
-	return true, nil
+	files := make([]repository.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		files = append(files, fileInfo(entry))
+	}
+	return files, nil
 }
 
-func (c *Client) UploadPackage(packageName string, archivePath string) error {
-	remotePath := c.packagePath(packageName)
-	log.Printf("uploading %q as package %s\n", archivePath, packageName)
-
-	srcFile, err := os.Open(archivePath)
+func (c *Client) Stat(name string) (repository.FileInfo, error) {
+	client, err := c.connect()
 	if err != nil {
-		return err
+		return repository.FileInfo{}, err
 	}
-	defer func() {
-		_ = srcFile.Close()
-	}()
-
-	dstFile, err := c.client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	entry, err := client.Stat(c.path(name))
 	if err != nil {
-		return fmt.Errorf("open remote file: %s", err)
+		return repository.FileInfo{}, err
 	}
-	defer func() {
-		_ = dstFile.Close()
-	}()
+	return fileInfo(entry), nil
+}
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("copy: %s", err)
+func fileInfo(entry os.FileInfo) repository.FileInfo {
+	return repository.FileInfo{
+		Name:    entry.Name(),
+		Size:    entry.Size(),
+		ModTime: entry.ModTime(),
 	}
+}
 
-	if err := srcFile.Close(); err != nil {
-		return fmt.Errorf("close %q: %s", srcFile.Name(), err)
-	}
-	if err := dstFile.Close(); err != nil {
-		return fmt.Errorf("close %q: %s", dstFile.Name(), err)
+func (c *Client) Open(name string) (io.ReadCloser, error) {
+	client, err := c.connect()
+	if err != nil {
+		return nil, err
 	}
+	return client.OpenFile(c.path(name), os.O_RDONLY)
+}
 
-	return nil
+// Put writes a temporary file and renames it to name.
+func (c *Client) Put(name string, r io.Reader) error {
+	return c.write(name, r, func(client *sftp.Client, oldpath, newpath string) error {
+		return client.PosixRename(oldpath, newpath)
+	})
 }
 
-func (c *Client) DownloadPackage(packageName string) (string, error) {
-	remotePath := c.packagePath(packageName)
+// Create writes a temporary file and hard links it as name, which fails if
+// name exists.
+func (c *Client) Create(name string, r io.Reader) error {
+	return c.write(name, r, func(client *sftp.Client, oldpath, newpath string) error {
+		err := client.Link(oldpath, newpath)
+		if err == nil {
+			return nil
+		}
+		// SFTP status codes don't tell why linking failed
+		if _, statErr := client.Lstat(newpath); statErr == nil {
+			return &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+		}
+		return err
+	})
+}
 
-	srcFile, err := c.client.OpenFile(remotePath, os.O_RDONLY)
+// write writes everything read from r into a temporary file, which is
+// then moved to name by publish.
+func (c *Client) write(name string, r io.Reader, publish func(client *sftp.Client, oldpath, newpath string) error) error {
+	client, err := c.connect()
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer func() {
-		_ = srcFile.Close()
-	}()
 
-	tmpFilePattern := fmt.Sprintf("%s-*.tar.gz", packageName)
-	dstFile, err := os.CreateTemp("", tmpFilePattern)
+	tmpPath := c.path(fmt.Sprintf(".%s.tmp-%d", name, rand.Uint32()))
+	dstFile, err := client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("open remote file: %s", err)
 	}
 	defer func() {
 		_ = dstFile.Close()
+		_ = client.Remove(tmpPath)
 	}()
 
-	log.Printf("downloading package %s to %q\n", packageName, dstFile.Name())
-
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return "", fmt.Errorf("copy: %s", err)
-	}
-
-	if err := srcFile.Close(); err != nil {
-		return "", fmt.Errorf("close %q: %s", srcFile.Name(), err)
+	if _, err := io.Copy(dstFile, r); err != nil {
+		return fmt.Errorf("copy: %s", err)
 	}
 	if err := dstFile.Close(); err != nil {
-		return "", fmt.Errorf("close %q: %s", dstFile.Name(), err)
+		return fmt.Errorf("close %q: %s", dstFile.Name(), err)
+	}
+	if err := publish(client, tmpPath, c.path(name)); err != nil {
+		return fmt.Errorf("publish %q: %w", name, err)
 	}
 
-	return dstFile.Name(), nil
-}
-
-func (c *Client) packagePath(packageName string) string {
-	return fmt.Sprintf("%s/%s", c.config.Path, packageName)
+	return nil
 }
 
-func (c *Client) PackagesDir() (string, error) {
-	workingDir, err := c.client.Getwd()
+func (c *Client) Delete(name string) error {
+	client, err := c.connect()
 	if err != nil {
-		return "", err
+		return err
 	}
-	return fmt.Sprintf("%s/%s", workingDir, c.config.Path), nil
+	return client.Remove(c.path(name))
 }
 
-func (c *Client) GetPackages() ([]os.FileInfo, error) {
-	return c.client.ReadDir(c.config.Path)
+func (c *Client) path(name string) string {
+	return fmt.Sprintf("%s/%s", c.config.Path, name)
 }
 
 func sshConnect(host, port, user string) (*ssh.Client, error) {
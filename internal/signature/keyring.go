@@ -0,0 +1,184 @@
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Config lists the files with trusted and revoked keys. It is read from
+// the same file as the sftp config.
+type Config struct {
+	// TrustedKeys is a file in authorized_keys format. The
+	// expiry-time="YYYYMMDD[HHMM[SS]]" option limits how long a key is
+	// trusted.
+	TrustedKeys string `json:"trusted_keys"`
+	// RevokedKeys is a file with keys in authorized_keys format or their
+	// SHA256 fingerprints, one per line. Revoked keys are never trusted.
+	RevokedKeys string `json:"revoked_keys"`
+}
+
+func ConfigFromFile(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf Config
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("unmarshal json: %s", err)
+	}
+
+	return &conf, nil
+}
+
+type trustedKey struct {
+	key     ssh.PublicKey
+	comment string
+	expires time.Time // zero if the key does not expire
+}
+
+// Keyring verifies package signatures against trusted keys.
+type Keyring struct {
+	trusted map[string]trustedKey // by fingerprint
+	revoked map[string]struct{}   // fingerprints
+}
+
+// NewKeyring loads keys listed in config. It returns nil if no trusted
+// keys are configured, which means signatures are not checked.
+func NewKeyring(config *Config) (*Keyring, error) {
+	if config.TrustedKeys == "" {
+		if config.RevokedKeys != "" {
+			return nil, errors.New("revoked_keys is set, but trusted_keys is not")
+		}
+		return nil, nil
+	}
+
+	k := &Keyring{
+		trusted: make(map[string]trustedKey),
+		revoked: make(map[string]struct{}),
+	}
+	if err := k.loadTrusted(config.TrustedKeys); err != nil {
+		return nil, fmt.Errorf("load trusted keys: %s", err)
+	}
+	if config.RevokedKeys != "" {
+		if err := k.loadRevoked(config.RevokedKeys); err != nil {
+			return nil, fmt.Errorf("load revoked keys: %s", err)
+		}
+	}
+
+	return k, nil
+}
+
+func (k *Keyring) loadTrusted(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return fmt.Errorf("%q: %s", path, err)
+		}
+		b = rest
+
+		tk := trustedKey{key: key, comment: comment}
+		for _, option := range options {
+			value, ok := strings.CutPrefix(option, "expiry-time=")
+			if !ok {
+				continue
+			}
+			tk.expires, err = parseExpiryTime(strings.Trim(value, `"`))
+			if err != nil {
+				return fmt.Errorf("%q: key %s: %s", path, ssh.FingerprintSHA256(key), err)
+			}
+		}
+		k.trusted[ssh.FingerprintSHA256(key)] = tk
+	}
+
+	return nil
+}
+
+func parseExpiryTime(s string) (time.Time, error) {
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(s) == len(layout) {
+			return time.ParseInLocation(layout, s, time.Local)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", s)
+}
+
+func (k *Keyring) loadRevoked(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "SHA256:") {
+			k.revoked[line] = struct{}{}
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("%q: %s", path, err)
+		}
+		k.revoked[ssh.FingerprintSHA256(key)] = struct{}{}
+	}
+
+	return scanner.Err()
+}
+
+// Verify checks that at least one of sigs is a valid signature of the
+// package made with a trusted key, which is neither revoked nor expired.
+// It returns a description of the key.
+func (k *Keyring) Verify(packageName, sha256Hex string, sigs *Signatures) (string, error) {
+	if sigs == nil || len(sigs.Signatures) == 0 {
+		return "", fmt.Errorf("package %s is not signed", packageName)
+	}
+
+	data := signedData(packageName, sha256Hex)
+	var errs []string
+	for _, sig := range sigs.Signatures {
+		err := k.verify(data, sig)
+		if err == nil {
+			return strings.TrimSpace(fmt.Sprintf("%s %s", sig.Key, k.trusted[sig.Key].comment)), nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", sig.Key, err))
+	}
+
+	return "", fmt.Errorf("package %s has no valid signature (%s)", packageName, strings.Join(errs, "; "))
+}
+
+func (k *Keyring) verify(data []byte, sig Signature) error {
+	if _, ok := k.revoked[sig.Key]; ok {
+		return errors.New("key is revoked")
+	}
+	tk, ok := k.trusted[sig.Key]
+	if !ok {
+		return errors.New("unknown key")
+	}
+	if !tk.expires.IsZero() && time.Now().After(tk.expires) {
+		return fmt.Errorf("key expired at %s", tk.expires)
+	}
+	if err := tk.key.Verify(data, &ssh.Signature{Format: sig.Format, Blob: sig.Blob}); err != nil {
+		return fmt.Errorf("bad signature: %s", err)
+	}
+	return nil
+}
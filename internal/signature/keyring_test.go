@@ -0,0 +1,103 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeyringVerify(t *testing.T) {
+	const (
+		packageName = "packet-1.0.0"
+		sum         = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	)
+
+	trusted := newTestSigner(t)
+	expired := newTestSigner(t)
+	revoked := newTestSigner(t)
+	unknown := newTestSigner(t)
+
+	dir := t.TempDir()
+	config := &Config{
+		TrustedKeys: writeTestFile(t, dir, "trusted_keys",
+			string(ssh.MarshalAuthorizedKey(trusted.PublicKey()))+
+				`expiry-time="20000101" `+string(ssh.MarshalAuthorizedKey(expired.PublicKey()))+
+				string(ssh.MarshalAuthorizedKey(revoked.PublicKey()))),
+		RevokedKeys: writeTestFile(t, dir, "revoked_keys", "# rotated\n"+ssh.FingerprintSHA256(revoked.PublicKey())+"\n"),
+	}
+	keyring, err := NewKeyring(config)
+	if err != nil {
+		t.Fatalf("NewKeyring returned error %q", err)
+	}
+
+	sign := func(signer ssh.Signer, packageName string) *Signatures {
+		sig, err := Sign(signer, packageName, sum)
+		if err != nil {
+			t.Fatalf("Sign returned error %q", err)
+		}
+		return &Signatures{Signatures: []Signature{sig}}
+	}
+
+	tests := []struct {
+		name    string
+		sigs    *Signatures
+		sum     string
+		wantErr bool
+	}{
+		{name: "trusted", sigs: sign(trusted, packageName), sum: sum},
+		{name: "unsigned", sigs: nil, sum: sum, wantErr: true},
+		{name: "expired", sigs: sign(expired, packageName), sum: sum, wantErr: true},
+		{name: "revoked", sigs: sign(revoked, packageName), sum: sum, wantErr: true},
+		{name: "unknown", sigs: sign(unknown, packageName), sum: sum, wantErr: true},
+		{name: "other package", sigs: sign(trusted, "packet-2.0.0"), sum: sum, wantErr: true},
+		{name: "other checksum", sigs: sign(trusted, packageName), sum: sum[1:] + "0", wantErr: true},
+		{
+			name: "rotated",
+			sigs: &Signatures{Signatures: append(sign(revoked, packageName).Signatures, sign(trusted, packageName).Signatures...)},
+			sum:  sum,
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := keyring.Verify(packageName, tt.sum, tt.sigs)
+		if err != nil && !tt.wantErr {
+			t.Errorf("%s: Verify returned error %q", tt.name, err)
+		}
+		if err == nil && tt.wantErr {
+			t.Errorf("%s: expected error from Verify", tt.name)
+		}
+	}
+}
+
+func TestNewKeyringWithoutTrustedKeys(t *testing.T) {
+	keyring, err := NewKeyring(&Config{})
+	if err != nil || keyring != nil {
+		t.Errorf("got %v, %v, want no keyring", keyring, err)
+	}
+}
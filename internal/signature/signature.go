@@ -0,0 +1,128 @@
+package signature
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Signature is a detached signature of a package archive made with an SSH
+// key. The signed data binds the package name to the archive digest, so a
+// signature can't be reused for another package.
+type Signature struct {
+	Key    string `json:"key"` // SHA256 fingerprint of the public key
+	Format string `json:"format"`
+	Blob   []byte `json:"blob"`
+}
+
+// Signatures is the content of the signature file published next to a
+// package. A package may be signed by several keys, e.g. while keys are
+// being rotated.
+type Signatures struct {
+	Signatures []Signature `json:"signatures"`
+}
+
+func SignaturesFromJSON(b []byte) (*Signatures, error) {
+	var sigs Signatures
+	if err := json.Unmarshal(b, &sigs); err != nil {
+		return nil, fmt.Errorf("unmarshal json: %s", err)
+	}
+	return &sigs, nil
+}
+
+func (s *Signatures) JSON() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// Add adds sig, replacing a signature made with the same key.
+func (s *Signatures) Add(sig Signature) {
+	for i := range s.Signatures {
+		if s.Signatures[i].Key == sig.Key {
+			s.Signatures[i] = sig
+			return
+		}
+	}
+	s.Signatures = append(s.Signatures, sig)
+}
+
+func signedData(packageName, sha256Hex string) []byte {
+	return []byte(fmt.Sprintf("pm-signature-v1\n%s\n%s\n", packageName, sha256Hex))
+}
+
+// Sign signs the archive of the package with the digest sha256Hex.
+func Sign(signer ssh.Signer, packageName, sha256Hex string) (Signature, error) {
+	data := signedData(packageName, sha256Hex)
+
+	var sig *ssh.Signature
+	var err error
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// plain "ssh-rsa" signatures use SHA-1
+		sig, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return Signature{}, fmt.Errorf("sign: %s", err)
+	}
+
+	return Signature{
+		Key:    ssh.FingerprintSHA256(signer.PublicKey()),
+		Format: sig.Format,
+		Blob:   sig.Blob,
+	}, nil
+}
+
+// NewSigner loads the signing key. key is either a path to an unencrypted
+// private key, a path to a public key whose private key is held by
+// ssh-agent, or "agent:<fingerprint>".
+func NewSigner(key string) (ssh.Signer, error) {
+	if fingerprint, ok := strings.CutPrefix(key, "agent:"); ok {
+		return agentSigner(fingerprint)
+	}
+
+	b, err := os.ReadFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if pubKey, _, _, _, err := ssh.ParseAuthorizedKey(b); err == nil {
+		return agentSigner(ssh.FingerprintSHA256(pubKey))
+	}
+
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key %q: %s", key, err)
+	}
+	return signer, nil
+}
+
+func agentSigner(fingerprint string) (ssh.Signer, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is empty")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("open SSH_AUTH_SOCK: %s", err)
+	}
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, fmt.Errorf("get agent keys: %s", err)
+	}
+	for _, signer := range signers {
+		if ssh.FingerprintSHA256(signer.PublicKey()) == fingerprint {
+			return signer, nil
+		}
+	}
+
+	return nil, fmt.Errorf("key %s not found in ssh-agent", fingerprint)
+}
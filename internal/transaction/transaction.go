@@ -0,0 +1,593 @@
+// Package transaction applies changes to an install root all at once.
+//
+// New files are first written into a staging directory next to the
+// installed files, so nothing is changed until every package is
+// extracted. On commit files are renamed into place one by one, and the
+// files they replace are moved aside. The journal of these renames is
+// written before they start, so after a failure, a signal or a crash the
+// install root can be restored to its state before the transaction.
+package transaction
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alew-moose/pm/internal/archive"
+)
+
+// Dir holds the state of the transaction relative to the install root.
+const Dir = archive.Dir + "/txn"
+
+const (
+	journalPath = Dir + "/journal.json"
+	stagingDir  = Dir + "/staging"
+	backupDir   = Dir + "/backup"
+)
+
+// journal describes the changes made on commit.
+type journal struct {
+	// Committed is set once all operations are applied, after that the
+	// transaction can't be rolled back.
+	Committed bool        `json:"committed"`
+	Ops       []operation `json:"ops"`
+	// Dirs are directories created on commit, parents first.
+	Dirs []string `json:"dirs,omitempty"`
+}
+
+// operation replaces or removes the file at Path. The previous file, if
+// any, is moved to Backup. Directories are created if needed and get
+// Mode and ModTime once all files are in place.
+type operation struct {
+	Path    string      `json:"path"`
+	Staged  string      `json:"staged,omitempty"` // empty for removals and directories
+	Backup  string      `json:"backup"`
+	Dir     bool        `json:"dir,omitempty"`
+	Mode    fs.FileMode `json:"mode,omitempty"`
+	ModTime time.Time   `json:"mtime,omitzero"`
+}
+
+type Transaction struct {
+	root    *os.Root
+	journal journal
+	done    bool
+}
+
+// Begin starts a transaction in the install root. An interrupted
+// transaction is recovered first.
+func Begin(root *os.Root) (*Transaction, error) {
+	if err := Recover(root); err != nil {
+		return nil, fmt.Errorf("recover interrupted transaction: %s", err)
+	}
+	for _, dir := range []string{stagingDir, backupDir} {
+		if err := root.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Transaction{root: root}, nil
+}
+
+// Recover rolls back a transaction interrupted before it was committed, or
+// finishes cleaning up after a committed one.
+func Recover(root *os.Root) error {
+	if _, err := root.Lstat(Dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	var j journal
+	b, err := root.ReadFile(journalPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// interrupted before commit, nothing was changed
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &j); err != nil {
+			return fmt.Errorf("parse journal: %s", err)
+		}
+		if !j.Committed {
+			log.Printf("rolling back interrupted transaction\n")
+			if err := rollback(root, &j); err != nil {
+				return err
+			}
+		}
+	}
+
+	return root.RemoveAll(Dir)
+}
+
+// Create returns a staged file which replaces the file name on commit.
+// The file gets exactly the mode, regardless of the umask.
+func (t *Transaction) Create(name string, mode fs.FileMode) (*os.File, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	op := t.add(name, true)
+	f, err := t.root.OpenFile(op.Staged, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Chtimes sets the modification time of the staged file name.
+func (t *Transaction) Chtimes(name string, mtime time.Time) error {
+	op, ok := t.staged(name)
+	if !ok {
+		return fmt.Errorf("%q is not staged", name)
+	}
+	return t.root.Chtimes(op.Staged, mtime, mtime)
+}
+
+// Symlink stages a symbolic link name pointing to target, which must not
+// lead outside the install root.
+func (t *Transaction) Symlink(name, target string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := archive.CheckSymlink(name, target); err != nil {
+		return err
+	}
+	op := t.add(name, true)
+	return t.root.Symlink(target, op.Staged)
+}
+
+// Link stages a hard link name to the file target staged earlier.
+func (t *Transaction) Link(name, target string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	targetOp, ok := t.staged(target)
+	if !ok {
+		return fmt.Errorf("hard link %q points to %q which is not staged", name, target)
+	}
+	targetStaged := targetOp.Staged
+	op := t.add(name, true)
+	return t.root.Link(targetStaged, op.Staged)
+}
+
+// Mkdir creates the directory name on commit, unless it exists, and sets
+// its mode and modification time.
+func (t *Transaction) Mkdir(name string, mode fs.FileMode, mtime time.Time) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	op := t.add(name, false)
+	op.Dir = true
+	op.Mode = mode
+	op.ModTime = mtime
+	return nil
+}
+
+// staged returns the last operation which stages the file name.
+func (t *Transaction) staged(name string) (*operation, bool) {
+	for i := len(t.journal.Ops) - 1; i >= 0; i-- {
+		op := &t.journal.Ops[i]
+		if op.Path == name && op.Staged != "" {
+			return op, true
+		}
+	}
+	return nil, false
+}
+
+// WriteFile stages data to be written to the file name on commit.
+func (t *Transaction) WriteFile(name string, data []byte, mode fs.FileMode) error {
+	f, err := t.Create(name, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Remove removes the file name on commit. Directories are only removed
+// if they are empty, and so are directories left empty.
+func (t *Transaction) Remove(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	t.add(name, false)
+	return nil
+}
+
+func checkName(name string) error {
+	if !filepath.IsLocal(name) || path.Clean(name) != name || name == Dir || strings.HasPrefix(name, Dir+"/") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+func (t *Transaction) add(name string, staged bool) *operation {
+	n := len(t.journal.Ops)
+	op := operation{
+		Path:   name,
+		Backup: fmt.Sprintf("%s/%d", backupDir, n),
+	}
+	if staged {
+		op.Staged = fmt.Sprintf("%s/%d", stagingDir, n)
+	}
+	t.journal.Ops = append(t.journal.Ops, op)
+	return &t.journal.Ops[n]
+}
+
+// Commit applies the staged changes. If anything fails, or the process
+// is interrupted by a signal, the changes are rolled back.
+func (t *Transaction) Commit() error {
+	if t.done {
+		return errors.New("transaction is already finished")
+	}
+	t.done = true
+
+	dirs, err := t.newDirs()
+	if err != nil {
+		_ = t.root.RemoveAll(Dir)
+		return err
+	}
+	t.journal.Dirs = dirs
+	if err := t.writeJournal(); err != nil {
+		_ = t.root.RemoveAll(Dir)
+		return fmt.Errorf("write journal: %s", err)
+	}
+
+	// a signal in the middle of the commit rolls it back instead of
+	// leaving a half-updated tree
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	for i, op := range t.journal.Ops {
+		select {
+		case sig := <-signals:
+			err = fmt.Errorf("interrupted by %s", sig)
+		default:
+			err = t.apply(op)
+		}
+		if err == nil && i == len(t.journal.Ops)-1 {
+			// adding files changes modification times of directories
+			err = t.applyDirs()
+		}
+		if err != nil {
+			log.Printf("transaction failed after %d of %d changes, rolling back\n", i, len(t.journal.Ops))
+			if rollbackErr := rollback(t.root, &t.journal); rollbackErr != nil {
+				return fmt.Errorf("%s; rollback failed: %s, run pm again to recover", err, rollbackErr)
+			}
+			_ = t.root.RemoveAll(Dir)
+			return err
+		}
+	}
+
+	t.journal.Committed = true
+	if err := t.writeJournal(); err != nil {
+		return fmt.Errorf("write journal: %s", err)
+	}
+
+	var removed []string
+	for _, op := range t.journal.Ops {
+		if op.Staged == "" && !op.Dir {
+			removed = append(removed, op.Path)
+		}
+	}
+	pruneDirs(t.root, removed)
+
+	return t.root.RemoveAll(Dir)
+}
+
+// Rollback discards the staged changes of a transaction that was not
+// committed. It does nothing after Commit, so it can be deferred.
+func (t *Transaction) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	return t.root.RemoveAll(Dir)
+}
+
+func (t *Transaction) apply(op operation) error {
+	if op.Staged != "" || op.Dir {
+		if err := t.checkParents(op); err != nil {
+			return err
+		}
+	}
+
+	fileInfo, err := t.root.Lstat(op.Path)
+	if op.Dir {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return t.root.MkdirAll(op.Path, 0755)
+		case err != nil:
+			return err
+		case fileInfo.Mode()&fs.ModeSymlink != 0:
+			// a link to a directory, like lib -> lib64, is kept
+			return t.checkDirLink(op.Path)
+		case !fileInfo.IsDir():
+			return fmt.Errorf("%q exists and is not a directory", op.Path)
+		}
+		return nil
+	}
+
+	switch {
+	case err == nil && fileInfo.IsDir() && op.Staged == "":
+		// removed later if empty
+		return nil
+	case err == nil && fileInfo.IsDir():
+		return fmt.Errorf("%q is a directory", op.Path)
+	case err == nil:
+		if err := t.root.Rename(op.Path, op.Backup); err != nil {
+			return err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	if op.Staged == "" {
+		log.Printf("removing file %q\n", op.Path)
+		return nil
+	}
+	if err := t.root.MkdirAll(path.Dir(op.Path), 0755); err != nil {
+		return err
+	}
+	return t.root.Rename(op.Staged, op.Path)
+}
+
+// checkParents returns an error if a parent directory of the operation
+// path is a symbolic link leading outside the root. Links inside the root,
+// like lib -> lib64, are followed. A staged symbolic link is checked
+// against the directory it really ends up in, as its relative target was
+// only checked against its path.
+func (t *Transaction) checkParents(op operation) error {
+	dir, err := t.realPath(path.Dir(op.Path))
+	if err != nil {
+		return fmt.Errorf("%q: %s", op.Path, err)
+	}
+	if op.Staged == "" || dir == path.Dir(op.Path) {
+		return nil
+	}
+	fileInfo, err := t.root.Lstat(op.Staged)
+	if err != nil {
+		return err
+	}
+	if fileInfo.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	target, err := t.root.Readlink(op.Staged)
+	if err != nil {
+		return err
+	}
+	if err := archive.CheckSymlink(path.Join(dir, path.Base(op.Path)), filepath.ToSlash(target)); err != nil {
+		return fmt.Errorf("%q is under a symbolic link: %s", op.Path, err)
+	}
+	return nil
+}
+
+// checkDirLink returns an error unless the symbolic link name leads to a
+// directory inside the root.
+func (t *Transaction) checkDirLink(name string) error {
+	if _, err := t.realPath(name); err != nil {
+		return fmt.Errorf("%q: %s", name, err)
+	}
+	fileInfo, err := t.root.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("%q is a symbolic link to a file, not a directory", name)
+	}
+	return nil
+}
+
+// maxSymlinks limits the number of symbolic links followed by realPath, so
+// that loops end.
+const maxSymlinks = 40
+
+// realPath returns the path of name relative to the root with symbolic
+// links resolved, or an error if one of them leads outside the root. The
+// part of name that doesn't exist is kept as it is.
+func (t *Transaction) realPath(name string) (string, error) {
+	resolved := "."
+	rest := strings.Split(name, "/")
+	for links := 0; len(rest) > 0; {
+		p := path.Join(resolved, rest[0])
+		rest = rest[1:]
+		fileInfo, err := t.root.Lstat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return path.Join(append([]string{p}, rest...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fileInfo.Mode()&fs.ModeSymlink == 0 {
+			resolved = p
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many symbolic links in %q", name)
+		}
+		target, err := t.root.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		target = filepath.ToSlash(target)
+		if path.IsAbs(target) || !filepath.IsLocal(path.Join(path.Dir(p), target)) {
+			return "", fmt.Errorf("symbolic link %q points outside the install root: %q", p, target)
+		}
+		rest = append(strings.Split(path.Join(path.Dir(p), target), "/"), rest...)
+		resolved = "."
+	}
+	return resolved, nil
+}
+
+// applyDirs sets modes and modification times of directories.
+func (t *Transaction) applyDirs() error {
+	for _, op := range t.journal.Ops {
+		if !op.Dir {
+			continue
+		}
+		fileInfo, err := t.root.Lstat(op.Path)
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode()&fs.ModeSymlink != 0 {
+			// the directory a link leads to keeps its mode
+			continue
+		}
+		if err := t.root.Chmod(op.Path, op.Mode); err != nil {
+			return err
+		}
+		if !op.ModTime.IsZero() {
+			if err := t.root.Chtimes(op.Path, op.ModTime, op.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newDirs returns directories that have to be created for staged files
+// and directories.
+func (t *Transaction) newDirs() ([]string, error) {
+	seen := make(map[string]struct{})
+	var dirs []string
+	for _, op := range t.journal.Ops {
+		if op.Staged == "" && !op.Dir {
+			continue
+		}
+		var parents []string
+		if op.Dir {
+			parents = append(parents, op.Path)
+		}
+		for dir := path.Dir(op.Path); dir != "."; dir = path.Dir(dir) {
+			parents = append(parents, dir)
+		}
+		slices.Reverse(parents)
+		for _, dir := range parents {
+			if _, ok := seen[dir]; ok {
+				continue
+			}
+			seen[dir] = struct{}{}
+			fileInfo, err := t.root.Lstat(dir)
+			if errors.Is(err, os.ErrNotExist) {
+				dirs = append(dirs, dir)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if fileInfo.Mode()&fs.ModeSymlink != 0 {
+				if err := t.checkDirLink(dir); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if !fileInfo.IsDir() {
+				return nil, fmt.Errorf("%q is not a directory", dir)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+func (t *Transaction) writeJournal() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t.journal); err != nil {
+		return err
+	}
+	tmpPath := journalPath + ".tmp"
+	f, err := t.root.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return t.root.Rename(tmpPath, journalPath)
+}
+
+// rollback undoes operations of the journal in reverse order. It only
+// relies on which staged and backup files exist, so it can be repeated
+// if it is interrupted itself.
+func rollback(root *os.Root, j *journal) error {
+	for i := len(j.Ops) - 1; i >= 0; i-- {
+		op := j.Ops[i]
+		if _, err := root.Lstat(op.Backup); err == nil {
+			if err := root.Rename(op.Backup, op.Path); err != nil {
+				return fmt.Errorf("restore %q: %s", op.Path, err)
+			}
+			continue
+		}
+		if op.Staged == "" {
+			continue
+		}
+		if _, err := root.Lstat(op.Staged); err == nil {
+			// not applied yet
+			continue
+		}
+		if err := root.Remove(op.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove %q: %s", op.Path, err)
+		}
+	}
+
+	for i := len(j.Dirs) - 1; i >= 0; i-- {
+		_ = root.Remove(j.Dirs[i])
+	}
+
+	return nil
+}
+
+// pruneDirs removes names which are empty directories and parent
+// directories of the names which are empty.
+func pruneDirs(root *os.Root, names []string) {
+	dirs := make(map[string]struct{})
+	for _, name := range names {
+		for dir := name; dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = struct{}{}
+		}
+	}
+
+	// deeper directories go first, so parents are empty when it's
+	// their turn
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	slices.SortFunc(sortedDirs, func(a, b string) int {
+		return strings.Count(b, "/") - strings.Count(a, "/")
+	})
+	for _, dir := range sortedDirs {
+		if fileInfo, err := root.Lstat(dir); err != nil || !fileInfo.IsDir() {
+			continue
+		}
+		if err := root.Remove(dir); err == nil {
+			log.Printf("removed empty dir %q\n", dir)
+		}
+	}
+}
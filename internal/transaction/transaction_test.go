@@ -0,0 +1,425 @@
+package transaction
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openRoot(t *testing.T, files map[string]string) *os.Root {
+	t.Helper()
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = root.Close()
+	})
+	for name, content := range files {
+		if err := root.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := root.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// readTree returns contents of all files in the root except the ones of
+// the transaction, and directories with empty contents.
+func readTree(t *testing.T, root *os.Root) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	var walk func(dir string)
+	walk = func(dir string) {
+		f, err := root.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := f.ReadDir(-1)
+		_ = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name())
+			if name == Dir {
+				continue
+			}
+			if entry.IsDir() {
+				tree[name+"/"] = ""
+				walk(name)
+				continue
+			}
+			b, err := root.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree[name] = string(b)
+		}
+	}
+	walk(".")
+	return tree
+}
+
+func stage(t *testing.T, txn *Transaction, files map[string]string, removed ...string) {
+	t.Helper()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := txn.WriteFile(name, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range removed {
+		if err := txn.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var before = map[string]string{
+	"bin/tool":      "tool 1",
+	"lib/old/a.so":  "a",
+	"share/doc.txt": "doc",
+}
+
+func TestCommit(t *testing.T) {
+	root := openRoot(t, before)
+	txn, err := Begin(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage(t, txn, map[string]string{
+		"bin/tool":     "tool 2",
+		"lib/new/b.so": "b",
+	}, "lib/old/a.so")
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit returned error %q", err)
+	}
+
+	want := map[string]string{
+		".pm/":          "",
+		"bin/":          "",
+		"bin/tool":      "tool 2",
+		"lib/":          "",
+		"lib/new/":      "",
+		"lib/new/b.so":  "b",
+		"share/":        "",
+		"share/doc.txt": "doc",
+	}
+	if got := readTree(t, root); !reflect.DeepEqual(got, want) {
+		t.Errorf("after commit: got %v, want %v", got, want)
+	}
+	if _, err := root.Lstat(Dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("transaction dir is not removed")
+	}
+}
+
+func TestCommitFailure(t *testing.T) {
+	root := openRoot(t, before)
+	txn, err := Begin(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last file can't replace a directory, so the whole
+	// transaction fails
+	stage(t, txn, map[string]string{
+		"bin/tool":     "tool 2",
+		"lib/new/b.so": "b",
+		"share":        "not a dir",
+	}, "lib/old/a.so")
+	if err := txn.Commit(); err == nil {
+		t.Fatalf("Commit succeeded")
+	}
+
+	want := map[string]string{
+		".pm/":          "",
+		"bin/":          "",
+		"bin/tool":      "tool 1",
+		"lib/":          "",
+		"lib/old/":      "",
+		"lib/old/a.so":  "a",
+		"share/":        "",
+		"share/doc.txt": "doc",
+	}
+	if got := readTree(t, root); !reflect.DeepEqual(got, want) {
+		t.Errorf("after failed commit: got %v, want %v", got, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	for applied := 0; applied <= 3; applied++ {
+		root := openRoot(t, before)
+		txn, err := Begin(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stage(t, txn, map[string]string{
+			"bin/tool":     "tool 2",
+			"lib/new/b.so": "b",
+		}, "lib/old/a.so")
+
+		// the process dies after applying some of the changes
+		if txn.journal.Dirs, err = txn.newDirs(); err != nil {
+			t.Fatal(err)
+		}
+		if err := txn.writeJournal(); err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range txn.journal.Ops[:applied] {
+			if err := txn.apply(op); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := Recover(root); err != nil {
+			t.Fatalf("%d applied: Recover returned error %q", applied, err)
+		}
+		want := map[string]string{
+			".pm/":          "",
+			"bin/":          "",
+			"bin/tool":      "tool 1",
+			"lib/":          "",
+			"lib/old/":      "",
+			"lib/old/a.so":  "a",
+			"share/":        "",
+			"share/doc.txt": "doc",
+		}
+		if got := readTree(t, root); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d applied: after recovery: got %v, want %v", applied, got, want)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	root := openRoot(t, before)
+	txn, err := Begin(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage(t, txn, map[string]string{"bin/tool": "tool 2"}, "share/doc.txt")
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("Rollback returned error %q", err)
+	}
+	if err := txn.Commit(); err == nil {
+		t.Errorf("Commit after Rollback succeeded")
+	}
+	if got := readTree(t, root); got["bin/tool"] != "tool 1" || got["share/doc.txt"] != "doc" {
+		t.Errorf("after rollback: got %v", got)
+	}
+}
+
+func TestCommitMetadata(t *testing.T) {
+	root := openRoot(t, nil)
+	txn, err := Begin(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := txn.Mkdir("etc", fs.ModeDir|0750, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Mkdir("var/empty", fs.ModeDir|0700, mtime); err != nil {
+		t.Fatal(err)
+	}
+	f, err := txn.Create("etc/secret", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Chtimes("etc/secret", mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Link("etc/secret.link", "etc/secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Symlink("etc/current", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Symlink("etc/escape", "../../secret"); err == nil {
+		t.Errorf("Symlink outside the root returned no error")
+	}
+	if err := txn.Link("etc/missing.link", "etc/missing"); err == nil {
+		t.Errorf("Link to a file which is not staged returned no error")
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit returned error %q", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		mode  fs.FileMode
+		mtime bool
+	}{
+		{"etc", fs.ModeDir | 0750, true},
+		{"var/empty", fs.ModeDir | 0700, true},
+		{"etc/secret", 0600, true},
+		{"etc/secret.link", 0600, true},
+		{"etc/current", fs.ModeSymlink, false},
+	} {
+		fileInfo, err := root.Lstat(tc.name)
+		if err != nil {
+			t.Errorf("%q: %s", tc.name, err)
+			continue
+		}
+		mode := fileInfo.Mode()
+		if mode.Type() == fs.ModeSymlink {
+			mode = fs.ModeSymlink
+		}
+		if mode != tc.mode {
+			t.Errorf("%q: got mode %s, want %s", tc.name, mode, tc.mode)
+		}
+		if tc.mtime && !fileInfo.ModTime().Equal(mtime) {
+			t.Errorf("%q: got mtime %s, want %s", tc.name, fileInfo.ModTime(), mtime)
+		}
+	}
+
+	if link, err := root.Readlink("etc/current"); err != nil || link != "secret" {
+		t.Errorf("etc/current: got link %q, error %v, want %q", link, err, "secret")
+	}
+	secret, err := root.Stat("etc/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretLink, err := root.Stat("etc/secret.link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(secret, secretLink) {
+		t.Errorf("etc/secret.link is not a hard link to etc/secret")
+	}
+}
+
+func TestCommitThroughSymlink(t *testing.T) {
+	for _, onDisk := range []bool{false, true} {
+		dir := t.TempDir()
+		if err := os.Mkdir(path.Join(dir, "root"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		root, err := os.OpenRoot(path.Join(dir, "root"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = root.Close()
+		}()
+		if onDisk {
+			if err := root.Symlink(".", "a"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		txn, err := Begin(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !onDisk {
+			if err := txn.Symlink("a", "."); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// "a/a/a/b" is "b" on disk, so the target is outside the root
+		if err := txn.Symlink("a/a/a/b", "../../../etc"); err != nil {
+			t.Fatal(err)
+		}
+		if err := txn.Commit(); err == nil || !strings.Contains(err.Error(), "symbolic link") {
+			t.Errorf("on disk %t: Commit through a symbolic link: got error %v", onDisk, err)
+		}
+
+		for _, name := range []string{"b", "root/b", "etc"} {
+			if _, err := os.Lstat(path.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("on disk %t: %q exists after the commit failed", onDisk, name)
+			}
+		}
+		if _, err := root.Lstat("a"); onDisk != (err == nil) {
+			t.Errorf("on disk %t: symbolic link \"a\": %v", onDisk, err)
+		}
+	}
+}
+
+func TestCommitThroughDirLink(t *testing.T) {
+	root := openRoot(t, map[string]string{"lib64/old.so": "old"})
+	if err := root.Symlink("lib64", "lib"); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := Begin(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Mkdir("lib", 0700, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	stage(t, txn, map[string]string{"lib/a.so": "a", "lib/sub/b.so": "b"})
+	if err := txn.Symlink("lib/c.so", "a.so"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit returned error %q", err)
+	}
+
+	if link, err := root.Readlink("lib"); err != nil || link != "lib64" {
+		t.Errorf("lib: got link %q, %v, want \"lib64\"", link, err)
+	}
+	if fileInfo, err := root.Stat("lib64"); err != nil || fileInfo.Mode().Perm() != 0755 {
+		t.Errorf("lib64: got %v, %v, want mode 0755 kept", fileInfo, err)
+	}
+	for name, want := range map[string]string{"lib64/old.so": "old", "lib64/a.so": "a", "lib64/sub/b.so": "b", "lib64/c.so": "a"} {
+		if b, err := root.ReadFile(name); err != nil || string(b) != want {
+			t.Errorf("%q: got %q, %v, want %q", name, b, err, want)
+		}
+	}
+}
+
+func TestCommitThroughOutsideLink(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"root", "outside"} {
+		if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../outside", path.Join(dir, "root", "lib")); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(path.Join(dir, "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	for _, name := range []string{"lib/a.so", "lib/sub/a.so"} {
+		txn, err := Begin(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stage(t, txn, map[string]string{name: "a"})
+		if err := txn.Commit(); err == nil || !strings.Contains(err.Error(), "points outside the install root") {
+			t.Errorf("%q: Commit through a link outside the root: got error %v", name, err)
+		}
+		entries, err := os.ReadDir(path.Join(dir, "outside"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%q: got %d files outside the root", name, len(entries))
+		}
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 
+	"github.com/alew-moose/pm/internal/archive"
 	"github.com/alew-moose/pm/internal/downloader"
+	"github.com/alew-moose/pm/internal/glob"
 	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/signature"
 	"github.com/alew-moose/pm/internal/version"
 )
 
@@ -19,12 +24,37 @@ type Config struct {
 	Version      version.Version          `json:"ver" yaml:"ver"`
 	Targets      []Target                 `json:"targets" yaml:"targets"`
 	Dependencies []pkg.PackageVersionSpec `json:"packets" yaml:"packets"`
+	// Replaces and Overwrite allow the package to take over files of
+	// other packages, see pkg.Metadata.
+	Replaces  []pkg.PackageName `json:"replaces,omitempty" yaml:"replaces,omitempty"`
+	Overwrite []string          `json:"overwrite,omitempty" yaml:"overwrite,omitempty"`
+	// Compression of the archive, archive.DefaultCompression if empty.
+	Compression archive.Compression `json:"compression,omitempty" yaml:"compression,omitempty"`
+	// Reproducible makes archives of the same files byte-for-byte equal:
+	// entries are sorted by name and all timestamps are SOURCE_DATE_EPOCH,
+	// or the Unix epoch if it is not set.
+	Reproducible bool `json:"reproducible,omitempty" yaml:"reproducible,omitempty"`
+
+	// Signer signs the package if it is not nil.
+	Signer ssh.Signer `json:"-" yaml:"-"`
+	// Keyring verifies signatures of dependencies if it is not nil.
+	Keyring *signature.Keyring `json:"-" yaml:"-"`
 }
 
 func (c *Config) FileName() string {
 	return fmt.Sprintf("%s-%s", c.Name, c.Version)
 }
 
+func (c *Config) Metadata() pkg.Metadata {
+	return pkg.Metadata{
+		Name:         c.Name,
+		Version:      c.Version,
+		Dependencies: c.Dependencies,
+		Replaces:     c.Replaces,
+		Overwrite:    c.Overwrite,
+	}
+}
+
 func ConfigFromFile(path string) (*Config, error) {
 	var config *Config
 	var err error
@@ -70,37 +100,103 @@ func fromYAML(b []byte) (*Config, error) {
 }
 
 func (c *Config) Validate() error {
-	if err := c.Name.Validate(); err != nil {
+	if err := c.Metadata().Validate(); err != nil {
 		return err
 	}
-	if err := c.Version.Validate(); err != nil {
-		return err
+	if c.Compression != "" {
+		if err := c.Compression.Validate(); err != nil {
+			return err
+		}
 	}
 	for _, target := range c.Targets {
 		if err := target.Validate(); err != nil {
 			return err
 		}
 	}
-	for _, dep := range c.Dependencies {
-		if err := dep.Validate(); err != nil {
-			return fmt.Errorf("invalid dependency: %s", err)
-		}
-	}
 	return nil
 }
 
+// Target selects files by a glob pattern, which may contain "**". Exclude
+// and Include are gitignore-style patterns matched against paths relative
+// to the static part of Path: a file is packed if it is not excluded and,
+// when Include is not empty, is matched by it.
+//
+// By default files are stored in the archive under their paths. If
+// StripPrefix is set, it is removed from the paths; otherwise, if Dest is
+// set, the static part of Path is removed. Then Dest is prepended, so
+// "./build/out/bin/*" with dest "bin" puts files into "bin/". Rename
+// replaces the path of the only file matched by the target.
 type Target struct {
-	Path    string
-	Exclude string
+	Path        string   `json:"path" yaml:"path"`
+	Exclude     []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	Include     []string `json:"include,omitempty" yaml:"include,omitempty"`
+	Dest        string   `json:"dest,omitempty" yaml:"dest,omitempty"`
+	StripPrefix string   `json:"strip_prefix,omitempty" yaml:"strip_prefix,omitempty"`
+	Rename      string   `json:"rename,omitempty" yaml:"rename,omitempty"`
 }
 
 func (t Target) Validate() error {
 	if t.Path == "" {
 		return errors.New("invalid target: empty path")
 	}
+	if err := glob.Validate(t.Path); err != nil {
+		return fmt.Errorf("invalid target path %q: %s", t.Path, err)
+	}
+	if _, err := glob.ParsePatterns(t.Exclude); err != nil {
+		return fmt.Errorf("invalid target %q exclude: %s", t.Path, err)
+	}
+	if _, err := glob.ParsePatterns(t.Include); err != nil {
+		return fmt.Errorf("invalid target %q include: %s", t.Path, err)
+	}
+	if t.Dest != "" && !filepath.IsLocal(t.Dest) {
+		return fmt.Errorf("invalid target %q dest %q: must be a relative path inside the install dir", t.Path, t.Dest)
+	}
+	if t.Rename != "" && !filepath.IsLocal(t.Rename) {
+		return fmt.Errorf("invalid target %q rename %q: must be a relative path inside the install dir", t.Path, t.Rename)
+	}
 	return nil
 }
 
+// ArchiveName returns the name under which the file at path, matched by
+// the target, is stored in the archive.
+func (t Target) ArchiveName(path string) (string, error) {
+	name := filepath.ToSlash(filepath.Clean(path))
+	switch {
+	case t.Rename != "":
+		name = t.Rename
+	case t.StripPrefix != "":
+		prefix := filepath.ToSlash(filepath.Clean(t.StripPrefix))
+		rest, ok := strings.CutPrefix(name, prefix+"/")
+		if name == prefix {
+			// the directory itself
+			rest, ok = ".", true
+		}
+		if !ok || prefix == "." {
+			return "", fmt.Errorf("%q does not start with strip_prefix %q", path, t.StripPrefix)
+		}
+		name = rest
+	case t.Dest != "":
+		base := glob.Base(t.Path)
+		rest, ok := strings.CutPrefix(name, base+"/")
+		if base == "." {
+			rest, ok = name, true
+		}
+		if base == name {
+			// the directory matched by "**"
+			rest, ok = ".", true
+		}
+		if !ok {
+			rest = filepath.Base(name)
+		}
+		name = rest
+	}
+	name = filepath.ToSlash(filepath.Join(t.Dest, name))
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%q is not a relative path inside the install dir", name)
+	}
+	return name, nil
+}
+
 func (t *Target) fromMap(m map[string]any) error {
 	path, ok := m["path"]
 	if !ok {
@@ -112,18 +208,61 @@ func (t *Target) fromMap(m map[string]any) error {
 	}
 	t.Path = pathStr
 
-	exclude, ok := m["exclude"]
-	if ok {
-		excludeStr, ok := exclude.(string)
+	if exclude, ok := m["exclude"]; ok {
+		excludeStrs, err := anyToStrings(exclude)
+		if err != nil {
+			return fmt.Errorf("exclude: %s", err)
+		}
+		t.Exclude = excludeStrs
+	}
+
+	if include, ok := m["include"]; ok {
+		includeStrs, err := anyToStrings(include)
+		if err != nil {
+			return fmt.Errorf("include: %s", err)
+		}
+		t.Include = includeStrs
+	}
+
+	for key, field := range map[string]*string{
+		"dest":         &t.Dest,
+		"strip_prefix": &t.StripPrefix,
+		"rename":       &t.Rename,
+	} {
+		val, ok := m[key]
+		if !ok {
+			continue
+		}
+		valStr, ok := val.(string)
 		if !ok {
-			return errors.New("exclude is not a string")
+			return fmt.Errorf("%s is not a string", key)
 		}
-		t.Exclude = excludeStr
+		*field = valStr
 	}
 
 	return nil
 }
 
+// anyToStrings accepts a string or a list of strings.
+func anyToStrings(v any) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case []any:
+		strs := make([]string, 0, len(v))
+		for _, elem := range v {
+			str, ok := elem.(string)
+			if !ok {
+				return nil, errors.New("not a string")
+			}
+			strs = append(strs, str)
+		}
+		return strs, nil
+	default:
+		return nil, errors.New("not a string or a list of strings")
+	}
+}
+
 func (t *Target) UnmarshalJSON(b []byte) error {
 	var targetAny any
 	if err := json.Unmarshal(b, &targetAny); err != nil {
@@ -163,16 +302,47 @@ func yamlNodesToTarget(nodes []*yaml.Node) (Target, error) {
 	i := 0
 	for i < len(nodes)-1 {
 		key := nodes[i].Value
-		val := nodes[i+1].Value
+		val := nodes[i+1]
+		var err error
 		switch key {
 		case "path":
-			target.Path = val
+			target.Path = val.Value
 		case "exclude":
-			target.Exclude = val
+			target.Exclude, err = yamlNodeToStrings(val)
+		case "include":
+			target.Include, err = yamlNodeToStrings(val)
+		case "dest":
+			target.Dest = val.Value
+		case "strip_prefix":
+			target.StripPrefix = val.Value
+		case "rename":
+			target.Rename = val.Value
 		default:
 			return target, fmt.Errorf("unknown field %q", key)
 		}
+		if err != nil {
+			return target, fmt.Errorf("%s: %s", key, err)
+		}
 		i += 2
 	}
 	return target, nil
 }
+
+// yamlNodeToStrings accepts a scalar or a sequence of scalars.
+func yamlNodeToStrings(node *yaml.Node) ([]string, error) {
+	switch kind := node.Kind; kind {
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		strs := make([]string, 0, len(node.Content))
+		for _, elem := range node.Content {
+			if elem.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("unsupported kind %d", elem.Kind)
+			}
+			strs = append(strs, elem.Value)
+		}
+		return strs, nil
+	default:
+		return nil, fmt.Errorf("unsupported kind %d", kind)
+	}
+}
@@ -0,0 +1,64 @@
+package uploader
+
+import (
+	"testing"
+)
+
+func TestTargetArchiveName(t *testing.T) {
+	tests := []struct {
+		target  Target
+		path    string
+		want    string
+		wantErr bool
+	}{
+		// files keep their paths by default
+		{target: Target{Path: "build/out/*.so"}, path: "build/out/a.so", want: "build/out/a.so"},
+		{target: Target{Path: "./build/out/*.so"}, path: "./build/out/a.so", want: "build/out/a.so"},
+		{target: Target{Path: "/etc/*.conf"}, path: "/etc/a.conf", wantErr: true},
+		{target: Target{Path: "../*.txt"}, path: "../a.txt", wantErr: true},
+
+		// dest cuts the static part of the path
+		{target: Target{Path: "./build/out/bin/*", Dest: "bin"}, path: "build/out/bin/tool", want: "bin/tool"},
+		{target: Target{Path: "build/**/*.so", Dest: "lib"}, path: "build/x/y/a.so", want: "lib/x/y/a.so"},
+		{target: Target{Path: "*.txt", Dest: "doc"}, path: "a.txt", want: "doc/a.txt"},
+		{target: Target{Path: "build/**", Dest: "out"}, path: "build", want: "out"},
+		{target: Target{Path: "build/**", Dest: "out"}, path: "build/sub", want: "out/sub"},
+		{target: Target{Path: "build/tool", Dest: "bin"}, path: "build/tool", want: "bin/tool"},
+		{target: Target{Path: "build/*", Dest: "../bin"}, path: "build/tool", wantErr: true},
+		{target: Target{Path: "build/*", Dest: "/usr/bin"}, path: "build/tool", wantErr: true},
+
+		// strip_prefix cuts whole path components
+		{target: Target{Path: "build/out/**", StripPrefix: "build/out"}, path: "build/out/bin/tool", want: "bin/tool"},
+		{target: Target{Path: "build/out/**", StripPrefix: "./build/out/"}, path: "build/out/bin/tool", want: "bin/tool"},
+		{target: Target{Path: "build/out/**", StripPrefix: "build/out", Dest: "opt"}, path: "build/out/bin/tool", want: "opt/bin/tool"},
+		{target: Target{Path: "build/out/**", StripPrefix: "build/out", Dest: "opt"}, path: "build/out", want: "opt"},
+		{target: Target{Path: "build/out/**", StripPrefix: "build/out"}, path: "build/out", want: "."},
+		{target: Target{Path: "build/out/**", StripPrefix: "build/ou"}, path: "build/out/tool", wantErr: true},
+		{target: Target{Path: "build/**", StripPrefix: "other"}, path: "build/tool", wantErr: true},
+		{target: Target{Path: "build/**", StripPrefix: "."}, path: "build/tool", wantErr: true},
+
+		// rename replaces the whole path
+		{target: Target{Path: "build/tool-v2", Rename: "tool"}, path: "build/tool-v2", want: "tool"},
+		{target: Target{Path: "build/tool-v2", Rename: "tool", Dest: "bin"}, path: "build/tool-v2", want: "bin/tool"},
+		{target: Target{Path: "build/tool-v2", Rename: "tool", StripPrefix: "other"}, path: "build/tool-v2", want: "tool"},
+		{target: Target{Path: "build/tool-v2", Rename: "../tool"}, path: "build/tool-v2", wantErr: true},
+		{target: Target{Path: "build/tool-v2", Rename: "tool", Dest: "../bin"}, path: "build/tool-v2", wantErr: true},
+	}
+
+	for i, test := range tests {
+		got, err := test.target.ArchiveName(test.path)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("failed test #%d: expected error, got %q", i, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed test #%d: unexpected error %q", i, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("failed test #%d: got %q, want %q", i, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package uploader
+
+import "io/fs"
+
+type fileID struct{}
+
+// hardLinkID always reports false: hard links are stored as separate
+// files on systems without inodes.
+func hardLinkID(fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
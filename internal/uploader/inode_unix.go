@@ -0,0 +1,24 @@
+//go:build unix
+
+package uploader
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID identifies a file with several hard links.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinkID returns the identity of a regular file which has other hard
+// links.
+func hardLinkID(fileInfo fs.FileInfo) (fileID, bool) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
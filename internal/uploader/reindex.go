@@ -0,0 +1,136 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/repository"
+)
+
+// Reindex rebuilds the index from the packages in the repository, e.g.
+// after an upload failed to update it or packages were removed by hand.
+func Reindex(repo repository.Repository) error {
+	return repository.ReplaceIndex(repo, func() (*repository.Index, error) {
+		return buildIndex(repo)
+	})
+}
+
+func buildIndex(repo repository.Repository) (*repository.Index, error) {
+	files, err := repo.List()
+	if err != nil {
+		return nil, fmt.Errorf("list repository: %s", err)
+	}
+	names, err := repository.Packages(repo)
+	if err != nil {
+		return nil, fmt.Errorf("get packages: %s", err)
+	}
+	sizes := make(map[string]int64, len(files))
+	for _, file := range files {
+		sizes[file.Name] = file.Size
+	}
+
+	index := &repository.Index{}
+	for _, name := range names {
+		pv, err := pkg.PackageVersionFromString(name)
+		if err != nil {
+			log.Printf("invalid package name %q: %s, skipping\n", name, err)
+			continue
+		}
+		p, err := indexPackage(repo, name, pv, sizes[name])
+		if err != nil {
+			return nil, fmt.Errorf("package %s: %s", name, err)
+		}
+		index.Add(*p)
+	}
+
+	return index, nil
+}
+
+// indexPackage takes the metadata and the checksum from the sidecar
+// files, falling back to the archive itself if they are missing.
+func indexPackage(repo repository.Repository, packageName string, pv pkg.PackageVersion, size int64) (*repository.IndexPackage, error) {
+	p := &repository.IndexPackage{File: packageName, Size: size}
+
+	metadata, err := repository.DownloadPackageMetadata(repo, packageName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("download metadata: %s", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(metadata, &p.Metadata); err != nil {
+			return nil, fmt.Errorf("parse metadata: %s", err)
+		}
+	}
+
+	sum, err := repository.DownloadPackageChecksum(repo, packageName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("download checksum: %s", err)
+	}
+	p.SHA256 = sum
+
+	if metadata == nil || sum == "" || size == 0 {
+		log.Printf("package %s has no metadata or checksum, reading the archive\n", packageName)
+		if err := readArchive(repo, pv, p, metadata == nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.Metadata.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %s", err)
+	}
+	if p.PackageVersion() != pv {
+		return nil, fmt.Errorf("metadata describes %s", p.PackageVersion())
+	}
+
+	return p, nil
+}
+
+// readArchive fills the checksum and the size of the package from its
+// archive, and the metadata from its manifest if withMetadata is set.
+func readArchive(repo repository.Repository, pv pkg.PackageVersion, p *repository.IndexPackage, withMetadata bool) error {
+	packageName := p.File
+	archivePath, err := repository.DownloadPackage(repo, packageName)
+	if err != nil {
+		return fmt.Errorf("download package: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(archivePath); err != nil {
+			log.Printf("remove %q: %s\n", archivePath, err)
+		}
+	}()
+
+	fileInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	p.Size = fileInfo.Size()
+
+	sum, err := checksum.FileSHA256(archivePath)
+	if err != nil {
+		return fmt.Errorf("checksum: %s", err)
+	}
+	if p.SHA256 != "" && p.SHA256 != sum {
+		return fmt.Errorf("checksum mismatch: published %s, downloaded %s", p.SHA256, sum)
+	}
+	p.SHA256 = sum
+
+	if withMetadata {
+		manifest, err := archive.ReadManifest(archivePath)
+		switch {
+		case errors.Is(err, archive.ErrNoManifest):
+			log.Printf("package %s has no manifest, assuming no dependencies\n", packageName)
+			p.Metadata = pkg.Metadata{Name: pv.Name, Version: pv.Version}
+		case err != nil:
+			return fmt.Errorf("read manifest: %s", err)
+		default:
+			p.Metadata = manifest.Metadata
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package uploader
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"testing"
+
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/repository"
+)
+
+func TestReindexTwoPartVersion(t *testing.T) {
+	// an archive of an old pm: two-part version, no manifest and no
+	// sidecar files
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := checksum.SHA256(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := repository.NewDir(filepath.Join(t.TempDir(), "repo"))
+	if err := repo.Put("packet-1.10", bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Reindex(repo); err != nil {
+		t.Fatalf("Reindex returned error %q", err)
+	}
+	index, err := repository.ReadIndex(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Packages) != 1 {
+		t.Fatalf("got %d packages in the index, want 1", len(index.Packages))
+	}
+	p := index.Packages[0]
+	if p.PackageVersion().String() != "packet-1.10.0" || p.FileName() != "packet-1.10" || p.SHA256 != sum || p.Size != int64(buf.Len()) {
+		t.Errorf("got %s in %q, sha256 %s, size %d, want packet-1.10.0 in \"packet-1.10\", sha256 %s, size %d",
+			p.PackageVersion(), p.FileName(), p.SHA256, p.Size, sum, buf.Len())
+	}
+}
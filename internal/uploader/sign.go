@@ -0,0 +1,78 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/alew-moose/pm/internal/checksum"
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/repository"
+	"github.com/alew-moose/pm/internal/signature"
+)
+
+// SignPackage adds a signature to an already published package, e.g. to
+// re-sign packages with a new key before the old one is revoked.
+func SignPackage(repo repository.Repository, signer ssh.Signer, pv pkg.PackageVersion) error {
+	packageName, err := repository.FindPackage(repo, pv)
+	if err != nil {
+		return fmt.Errorf("find package: %s", err)
+	}
+	archivePath, err := repository.DownloadPackage(repo, packageName)
+	if err != nil {
+		return fmt.Errorf("download package: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(archivePath); err != nil {
+			log.Printf("remove %q: %s\n", archivePath, err)
+		}
+	}()
+
+	sum, err := checksum.FileSHA256(archivePath)
+	if err != nil {
+		return fmt.Errorf("checksum: %s", err)
+	}
+	publishedSum, err := repository.DownloadPackageChecksum(repo, packageName)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Printf("package %s has no published checksum, signing the downloaded archive\n", packageName)
+	case err != nil:
+		return fmt.Errorf("download checksum: %s", err)
+	case sum != publishedSum:
+		return fmt.Errorf("checksum mismatch: published %s, downloaded %s", publishedSum, sum)
+	}
+
+	return uploadSignature(repo, signer, packageName, sum)
+}
+
+// uploadSignature signs the package archive and adds the signature to the
+// ones already published.
+func uploadSignature(repo repository.Repository, signer ssh.Signer, packageName, sum string) error {
+	sig, err := signature.Sign(signer, packageName, sum)
+	if err != nil {
+		return err
+	}
+	log.Printf("signed package %s with key %s\n", packageName, sig.Key)
+
+	sigs := &signature.Signatures{}
+	b, err := repository.DownloadPackageSignatures(repo, packageName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("download signatures: %s", err)
+	}
+	if err == nil {
+		sigs, err = signature.SignaturesFromJSON(b)
+		if err != nil {
+			return fmt.Errorf("parse signatures: %s", err)
+		}
+	}
+	sigs.Add(sig)
+
+	b, err = sigs.JSON()
+	if err != nil {
+		return fmt.Errorf("marshal signatures: %s", err)
+	}
+	return repository.UploadPackageSignatures(repo, packageName, b)
+}
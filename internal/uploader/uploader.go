@@ -2,38 +2,58 @@ package uploader
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/checksum"
 	"github.com/alew-moose/pm/internal/downloader"
-	"github.com/alew-moose/pm/internal/sftp"
+	"github.com/alew-moose/pm/internal/glob"
+	"github.com/alew-moose/pm/internal/repository"
 )
 
 type PackageUploader struct {
 	config     *Config
-	sftpClient *sftp.Client
+	repo       repository.Repository
 	downloader *downloader.PackageDownloader
+	buildTime  time.Time
 }
 
-func NewPackageUploader(config *Config, sftpClient *sftp.Client) (*PackageUploader, error) {
+func NewPackageUploader(config *Config, repo repository.Repository) (*PackageUploader, error) {
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid config: %s", err)
 	}
+	if config.Compression == "" {
+		config.Compression = archive.DefaultCompression
+	}
+	buildTime, err := buildTime(config.Reproducible)
+	if err != nil {
+		return nil, err
+	}
 	pu := &PackageUploader{
-		config:     config,
-		sftpClient: sftpClient,
+		config:    config,
+		repo:      repo,
+		buildTime: buildTime,
 	}
 	if len(config.Dependencies) > 0 {
 		downloaderConfig := &downloader.Config{
 			Packages: config.Dependencies,
+			Keyring:  config.Keyring,
 		}
-		pd, err := downloader.NewPackageDownloader(downloaderConfig, sftpClient)
+		pd, err := downloader.NewPackageDownloader(downloaderConfig, repo)
 		if err != nil {
 			return nil, fmt.Errorf("create new downloader: %s", err)
 		}
@@ -42,14 +62,32 @@ func NewPackageUploader(config *Config, sftpClient *sftp.Client) (*PackageUpload
 	return pu, nil
 }
 
+// buildTime returns the time the package is built at: SOURCE_DATE_EPOCH
+// if it is set, otherwise the current time, or the Unix epoch for
+// reproducible packages.
+func buildTime(reproducible bool) (time.Time, error) {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %s", epoch, err)
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	if reproducible {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	return time.Now().UTC().Truncate(time.Second), nil
+}
+
 func (u *PackageUploader) Upload() error {
 	packageName := u.config.FileName()
-	packageExists, err := u.sftpClient.PackageExists(packageName)
-	if err != nil {
-		return fmt.Errorf("check if package exists: %s", err)
+	// old packages may have two-part versions in their names
+	existing, err := repository.FindPackage(u.repo, u.config.Metadata().PackageVersion())
+	if err == nil {
+		return fmt.Errorf("package %s already exists", existing)
 	}
-	if packageExists {
-		return fmt.Errorf("package %s already exists", packageName)
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("check if package exists: %s", err)
 	}
 
 	if len(u.config.Dependencies) > 0 {
@@ -59,14 +97,9 @@ func (u *PackageUploader) Upload() error {
 		}
 	}
 
-	paths, err := u.getPaths()
+	archivePath, err := u.buildArchive()
 	if err != nil {
-		return fmt.Errorf("get paths: %s", err)
-	}
-
-	archivePath, err := u.createArchive(paths)
-	if err != nil {
-		return fmt.Errorf("create archive: %s", err)
+		return err
 	}
 	defer func() {
 		err := os.Remove(archivePath)
@@ -75,70 +108,303 @@ func (u *PackageUploader) Upload() error {
 		}
 	}()
 
-	if err := u.sftpClient.UploadPackage(u.config.FileName(), archivePath); err != nil {
-		return fmt.Errorf("sftp client upload package: %s", err)
+	sum, err := checksum.FileSHA256(archivePath)
+	if err != nil {
+		return fmt.Errorf("checksum: %s", err)
+	}
+	// the checksum is created only if there is none, so of concurrent
+	// uploads of the same version only one gets further
+	if err := repository.UploadPackageChecksum(u.repo, packageName, sum); errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("package %s is being uploaded or an earlier upload failed, remove %s from the repository to retry", packageName, packageName+repository.ChecksumSuffix)
+	} else if err != nil {
+		return fmt.Errorf("upload checksum: %s", err)
+	}
+	published := false
+	defer func() {
+		if !published {
+			u.removeChecksum(packageName)
+		}
+	}()
+
+	// metadata and signatures go next: a package is only visible once its
+	// archive is uploaded, and then it must already have them
+	if u.config.Signer != nil {
+		if err := uploadSignature(u.repo, u.config.Signer, packageName, sum); err != nil {
+			return fmt.Errorf("upload signature: %s", err)
+		}
+	}
+
+	if err := u.uploadMetadata(); err != nil {
+		return fmt.Errorf("upload metadata: %s", err)
+	}
+
+	if err := repository.UploadPackage(u.repo, packageName, archivePath); err != nil {
+		return fmt.Errorf("upload package: %s", err)
+	}
+	published = true
+
+	if err := u.addToIndex(archivePath, sum); err != nil {
+		return fmt.Errorf("package %s is uploaded, but the index is not updated, run reindex: %s", packageName, err)
 	}
 
 	return nil
 }
 
-func (u *PackageUploader) getPaths() ([]string, error) {
-	seen := make(map[string]struct{})
-	var paths []string
+// removeChecksum removes the checksum of a failed upload, so that it can
+// be retried. It is kept if the archive was uploaded nevertheless, e.g.
+// only the response was lost.
+func (u *PackageUploader) removeChecksum(packageName string) {
+	exists, err := repository.PackageExists(u.repo, packageName)
+	if err != nil {
+		log.Printf("check if package %s exists: %s, keeping its checksum\n", packageName, err)
+		return
+	}
+	if exists {
+		return
+	}
+	log.Printf("removing checksum of package %s\n", packageName)
+	if err := u.repo.Delete(packageName + repository.ChecksumSuffix); err != nil {
+		log.Printf("remove checksum of package %s: %s, remove %s from the repository to retry\n",
+			packageName, err, packageName+repository.ChecksumSuffix)
+	}
+}
+
+// buildArchive packs the files of the targets into a temporary archive and
+// returns its path.
+func (u *PackageUploader) buildArchive() (string, error) {
+	files, err := u.getFiles()
+	if err != nil {
+		return "", fmt.Errorf("get files: %s", err)
+	}
+	if u.config.Reproducible {
+		slices.SortFunc(files, func(a, b packFile) int {
+			return strings.Compare(a.name, b.name)
+		})
+	}
+
+	manifest, err := u.createManifest(files)
+	if err != nil {
+		return "", fmt.Errorf("create manifest: %s", err)
+	}
+
+	archivePath, err := u.createArchive(files, manifest)
+	if err != nil {
+		return "", fmt.Errorf("create archive: %s", err)
+	}
+
+	return archivePath, nil
+}
+
+func (u *PackageUploader) addToIndex(archivePath, sum string) error {
+	fileInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	return repository.UpdateIndex(u.repo, func(index *repository.Index) error {
+		index.Add(repository.IndexPackage{
+			Metadata: u.config.Metadata(),
+			File:     u.config.FileName(),
+			SHA256:   sum,
+			Size:     fileInfo.Size(),
+		})
+		return nil
+	})
+}
+
+func (u *PackageUploader) uploadMetadata() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // keep version specs like ">=1.0" readable
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(u.config.Metadata()); err != nil {
+		return fmt.Errorf("marshal json: %s", err)
+	}
+	return repository.UploadPackageMetadata(u.repo, u.config.FileName(), buf.Bytes())
+}
+
+// packFile is a file to be packed: src is its path on disk, name is the
+// path in the archive.
+type packFile struct {
+	src      string
+	name     string
+	fileInfo fs.FileInfo // of src itself, symbolic links are not followed
+}
+
+func (u *PackageUploader) getFiles() ([]packFile, error) {
+	sources := make(map[string]packFile) // by archive name
+	var files []packFile
 	for _, target := range u.config.Targets {
-		log.Printf("find files for target %q excluding %q\n", target.Path, target.Exclude)
-		files, err := filepath.Glob(target.Path)
+		targetFiles, err := targetFiles(target)
 		if err != nil {
-			return nil, fmt.Errorf("glob %q: %s", target.Path, err)
+			return nil, fmt.Errorf("target %q: %s", target.Path, err)
 		}
-		for _, file := range files {
-			log.Printf("found file %q\n", file)
-		}
-		files, err = filterPaths(files, target.Exclude)
-		if err != nil {
-			return nil, fmt.Errorf("filter paths: %s", err)
+		if target.Rename != "" && len(targetFiles) != 1 {
+			return nil, fmt.Errorf("target %q: rename needs exactly one file, found %d", target.Path, len(targetFiles))
 		}
-		for _, file := range files {
-			if _, ok := seen[file]; ok {
-				log.Printf("duplicate file %q, skipping\n", file)
+		for _, file := range targetFiles {
+			name, err := target.ArchiveName(file.src)
+			if err != nil {
+				return nil, fmt.Errorf("target %q: %s", target.Path, err)
+			}
+			if name == "." {
+				// the directory files are installed into
+				continue
+			}
+			if archive.IsReserved(name) {
+				// e.g. the database of dependencies installed here
+				log.Printf("%q is reserved for pm, skipping\n", name)
 				continue
 			}
-			seen[file] = struct{}{}
-			paths = append(paths, file)
+			if other, ok := sources[name]; ok {
+				if other.src == file.src || (other.fileInfo.IsDir() && file.fileInfo.IsDir()) {
+					log.Printf("duplicate %q, skipping\n", file.src)
+					continue
+				}
+				return nil, fmt.Errorf("both %q and %q are packed as %q", other.src, file.src, name)
+			}
+			if name != filepath.ToSlash(file.src) {
+				log.Printf("packing %q as %q\n", file.src, name)
+			}
+			file.name = name
+			sources[name] = file
+			files = append(files, file)
 		}
 	}
-	return paths, nil
+	return files, nil
 }
 
-func filterPaths(paths []string, exclude string) ([]string, error) {
-	if exclude == "" {
-		return paths, nil
+// targetFiles returns files, directories and symbolic links matching the
+// target. Exclude and include patterns are matched against paths relative
+// to the static part of the target path, so "*.tmp" matches temporary
+// files at any depth.
+func targetFiles(target Target) ([]packFile, error) {
+	log.Printf("find files for target %q excluding %q including %q\n", target.Path, target.Exclude, target.Include)
+	excludes, err := glob.ParsePatterns(target.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("parse exclude: %s", err)
+	}
+	includes, err := glob.ParsePatterns(target.Include)
+	if err != nil {
+		return nil, fmt.Errorf("parse include: %s", err)
 	}
-	filtered := make([]string, 0, len(paths))
-	excludeRe, err := excludeStrToRegexp(exclude)
+
+	paths, err := glob.Glob(target.Path)
 	if err != nil {
-		return nil, fmt.Errorf("exclude str to regexp: %s", err)
+		return nil, fmt.Errorf("glob: %s", err)
 	}
+
+	base := glob.Base(target.Path)
+	var files []packFile
 	for _, path := range paths {
-		if excludeRe.MatchString(path) {
-			log.Printf("excluded %q by %q\n", path, excludeRe)
-		} else {
-			filtered = append(filtered, path)
+		fileInfo, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
 		}
+
+		rel, err := filepath.Rel(base, path)
+		if err != nil || (rel == "." && !fileInfo.IsDir()) {
+			// the target names the file itself
+			rel = filepath.Base(path)
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && excludes.MatchPath(rel, fileInfo.IsDir()) {
+			log.Printf("excluded %q\n", path)
+			continue
+		}
+		if rel != "." && len(includes) > 0 && !includes.MatchPath(rel, fileInfo.IsDir()) {
+			log.Printf("not included %q\n", path)
+			continue
+		}
+
+		log.Printf("found %q\n", path)
+		files = append(files, packFile{src: path, fileInfo: fileInfo})
+	}
+	return files, nil
+}
+
+// createManifest describes the files, hashing contents of regular files.
+func (u *PackageUploader) createManifest(files []packFile) (*archive.Manifest, error) {
+	targets, err := json.Marshal(u.config.Targets)
+	if err != nil {
+		return nil, fmt.Errorf("marshal targets: %s", err)
+	}
+
+	manifest := &archive.Manifest{
+		Metadata:  u.config.Metadata(),
+		Targets:   targets,
+		BuildTime: u.buildTime,
+		Files:     make([]archive.File, 0, len(files)),
+	}
+
+	hardLinks := make(map[fileID]archive.File)
+	for _, file := range files {
+		manifestFile := archive.File{
+			Path:    file.name,
+			Mode:    file.fileInfo.Mode(),
+			ModTime: file.fileInfo.ModTime().UTC().Truncate(time.Second),
+		}
+		if u.config.Reproducible {
+			manifestFile.ModTime = u.buildTime
+		}
+
+		switch mode := file.fileInfo.Mode(); {
+		case mode.IsDir():
+		case mode&fs.ModeSymlink != 0:
+			manifestFile.Link, err = os.Readlink(file.src)
+			if err != nil {
+				return nil, err
+			}
+			manifestFile.Link = filepath.ToSlash(manifestFile.Link)
+			if err := archive.CheckSymlink(file.name, manifestFile.Link); err != nil {
+				return nil, err
+			}
+		case mode.IsRegular():
+			id, isHardLink := hardLinkID(file.fileInfo)
+			if linked, ok := hardLinks[id]; isHardLink && ok {
+				manifestFile.Link = linked.Path
+				manifestFile.Size = linked.Size
+				manifestFile.SHA256 = linked.SHA256
+				break
+			}
+			manifestFile.Size, manifestFile.SHA256, err = hashFile(file.src)
+			if err != nil {
+				return nil, fmt.Errorf("hash %q: %s", file.src, err)
+			}
+			if isHardLink {
+				hardLinks[id] = manifestFile
+			}
+		default:
+			return nil, fmt.Errorf("%q: unsupported file type %s", file.src, mode.Type())
+		}
+
+		manifest.Files = append(manifest.Files, manifestFile)
 	}
-	return filtered, nil
+
+	return manifest, nil
 }
 
-func excludeStrToRegexp(exclude string) (*regexp.Regexp, error) {
-	exclude = regexp.QuoteMeta(exclude)
-	exclude = strings.ReplaceAll(exclude, `\*`, ".*")
-	exclude = strings.ReplaceAll(exclude, `\?`, ".?")
-	exclude = "^" + exclude + "$"
-	return regexp.Compile(exclude)
+func hashFile(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, "", fmt.Errorf("read: %s", err)
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func (u *PackageUploader) createArchive(paths []string) (string, error) {
-	tmpFilePattern := fmt.Sprintf("%s-%s-*.tar.gz", u.config.Name, u.config.Version)
+// createArchive packs the files, which are described by the manifest
+// entries with the same indexes.
+func (u *PackageUploader) createArchive(files []packFile, manifest *archive.Manifest) (string, error) {
+	tmpFilePattern := fmt.Sprintf("%s-%s-*%s", u.config.Name, u.config.Version, u.config.Compression.Ext())
 	f, err := os.CreateTemp("", tmpFilePattern)
 	if err != nil {
 		return "", fmt.Errorf("create temp file: %s", err)
@@ -148,27 +414,34 @@ func (u *PackageUploader) createArchive(paths []string) (string, error) {
 		_ = f.Close()
 	}()
 
-	gzw := gzip.NewWriter(f)
+	cw, err := archive.NewWriter(f, u.config.Compression)
+	if err != nil {
+		return "", err
+	}
 	defer func() {
-		_ = gzw.Close()
+		_ = cw.Close()
 	}()
-	tw := tar.NewWriter(gzw)
+	tw := tar.NewWriter(cw)
 	defer func() {
 		_ = tw.Close()
 	}()
 
-	for _, path := range paths {
-		log.Printf("adding file %q\n", path)
-		if err := u.addFile(tw, path); err != nil {
-			return "", fmt.Errorf("add file %q: %s", path, err)
+	if err := archive.WriteManifest(tw, manifest); err != nil {
+		return "", fmt.Errorf("write manifest: %s", err)
+	}
+
+	for i, file := range files {
+		log.Printf("adding %q\n", file.src)
+		if err := u.addFile(tw, file.src, manifest.Files[i]); err != nil {
+			return "", fmt.Errorf("add file %q: %s", file.src, err)
 		}
 	}
 
 	if err := tw.Close(); err != nil {
 		return "", fmt.Errorf("close tar writer: %s", err)
 	}
-	if err := gzw.Close(); err != nil {
-		return "", fmt.Errorf("close gzip writer: %s", err)
+	if err := cw.Close(); err != nil {
+		return "", fmt.Errorf("close %s writer: %s", u.config.Compression, err)
 	}
 	if err := f.Close(); err != nil {
 		return "", fmt.Errorf("close temp file: %s", err)
@@ -177,7 +450,37 @@ func (u *PackageUploader) createArchive(paths []string) (string, error) {
 	return f.Name(), nil
 }
 
-func (u *PackageUploader) addFile(tw *tar.Writer, path string) error {
+// addFile adds the file at path described by the manifest entry, making
+// sure contents of regular files did not change after the manifest was
+// created.
+func (u *PackageUploader) addFile(tw *tar.Writer, path string, manifestFile archive.File) error {
+	header := &tar.Header{
+		Name:    manifestFile.Path,
+		Mode:    tarMode(manifestFile.Mode),
+		ModTime: manifestFile.ModTime,
+	}
+	switch {
+	case manifestFile.Mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case manifestFile.Mode&fs.ModeSymlink != 0:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = manifestFile.Link
+	case manifestFile.Link != "":
+		header.Typeflag = tar.TypeLink
+		header.Linkname = manifestFile.Link
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = manifestFile.Size
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("write header: %s", err)
+		}
+		return nil
+	}
+
 	file, err := os.Open(path)
 	if err != nil {
 		return err
@@ -190,21 +493,21 @@ func (u *PackageUploader) addFile(tw *tar.Writer, path string) error {
 	if err != nil {
 		return fmt.Errorf("stat: %s", err)
 	}
-
-	header, err := tar.FileInfoHeader(fileInfo, fileInfo.Name())
-	if err != nil {
-		return fmt.Errorf("file info header: %s", err)
+	if !fileInfo.Mode().IsRegular() || fileInfo.Size() != manifestFile.Size {
+		return fmt.Errorf("file changed while packing: size %d, expected %d", fileInfo.Size(), manifestFile.Size)
 	}
-	header.Name = path
 
-	err = tw.WriteHeader(header)
-	if err != nil {
+	if err := tw.WriteHeader(header); err != nil {
 		return fmt.Errorf("write header: %s", err)
 	}
 
-	if _, err := io.Copy(tw, file); err != nil {
+	h := sha256.New()
+	if _, err := io.Copy(tw, io.TeeReader(file, h)); err != nil {
 		return fmt.Errorf("copy: %s", err)
 	}
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != manifestFile.SHA256 {
+		return fmt.Errorf("file changed while packing: sha256 %s, expected %s", checksum, manifestFile.SHA256)
+	}
 
 	if err := file.Close(); err != nil {
 		return fmt.Errorf("close %q: %s", file.Name(), err)
@@ -212,3 +515,18 @@ func (u *PackageUploader) addFile(tw *tar.Writer, path string) error {
 
 	return nil
 }
+
+// tarMode returns permission bits of mode in tar format.
+func tarMode(mode fs.FileMode) int64 {
+	tarMode := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		tarMode |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		tarMode |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		tarMode |= 0o1000
+	}
+	return tarMode
+}
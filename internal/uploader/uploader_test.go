@@ -0,0 +1,232 @@
+package uploader
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alew-moose/pm/internal/archive"
+	"github.com/alew-moose/pm/internal/downloader"
+	"github.com/alew-moose/pm/internal/pkg"
+	"github.com/alew-moose/pm/internal/repository"
+	"github.com/alew-moose/pm/internal/version"
+)
+
+// writeTree creates the files under dir with the modification time.
+// Names ending with "/" are directories.
+func writeTree(t *testing.T, dir string, files map[string]string, mtime time.Time) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// parents get the time after their contents are created
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, mtime, mtime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPackage returns a config of the package packing the tree at dir.
+func testPackage(t *testing.T, name, ver, dir string) *Config {
+	t.Helper()
+	v, err := version.VersionFromString(ver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		Name:    pkg.PackageName(name),
+		Version: v,
+		Targets: []Target{{Path: filepath.ToSlash(dir) + "/**", StripPrefix: filepath.ToSlash(dir)}},
+	}
+}
+
+func upload(t *testing.T, repo repository.Repository, config *Config) error {
+	t.Helper()
+	u, err := NewPackageUploader(config, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Upload()
+}
+
+// buildTestArchive builds the archive of the package and returns it.
+func buildTestArchive(t *testing.T, config *Config) []byte {
+	t.Helper()
+	u, err := NewPackageUploader(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath, err := u.buildArchive()
+	if err != nil {
+		t.Fatalf("buildArchive returned error %q", err)
+	}
+	defer func() {
+		_ = os.Remove(archivePath)
+	}()
+	b, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+var testFiles = map[string]string{
+	"bin/tool":       "tool",
+	"share/doc.txt":  "doc",
+	"share/b/c.txt":  "c",
+	"share/a/z.txt":  "z",
+	"share/a/empty/": "",
+}
+
+func TestReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	compressions := []archive.Compression{
+		archive.CompressionGzip,
+		archive.CompressionZstd,
+		archive.CompressionXz,
+		archive.CompressionNone,
+	}
+
+	for i, compression := range compressions {
+		// targets are in the manifest, so the files are at the same path
+		src := filepath.Join(t.TempDir(), "src")
+		var archives [][]byte
+		for _, mtime := range []time.Time{
+			time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC),
+		} {
+			if err := os.RemoveAll(src); err != nil {
+				t.Fatal(err)
+			}
+			writeTree(t, src, testFiles, mtime)
+			config := testPackage(t, "packet", "1.0.0", src)
+			config.Compression = compression
+			config.Reproducible = true
+			archives = append(archives, buildTestArchive(t, config))
+		}
+		if !bytes.Equal(archives[0], archives[1]) {
+			t.Errorf("failed test #%d: %s archives of the same files differ", i, compression)
+		}
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	// dependencies are installed into the current directory on upload
+	t.Chdir(t.TempDir())
+	repo := repository.NewDir(filepath.Join(t.TempDir(), "repo"))
+
+	lib := t.TempDir()
+	writeTree(t, lib, map[string]string{"lib/a.so": "a"}, time.Now())
+	if err := upload(t, repo, testPackage(t, "lib", "1.0.0", lib)); err != nil {
+		t.Fatalf("Upload of lib returned error %q", err)
+	}
+	app := t.TempDir()
+	writeTree(t, app, map[string]string{"bin/app": "app"}, time.Now())
+	config := testPackage(t, "app", "1.0.0", app)
+	spec, err := version.VersionSpecFromString(">=1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Dependencies = []pkg.PackageVersionSpec{{Name: "lib", VersionSpec: spec}}
+	if err := upload(t, repo, config); err != nil {
+		t.Fatalf("Upload of app returned error %q", err)
+	}
+	if err := upload(t, repo, testPackage(t, "lib", "1.0.0", lib)); err == nil {
+		t.Errorf("second Upload of lib-1.0.0 returned no error")
+	}
+
+	index, err := repository.ReadIndex(repo)
+	if err != nil {
+		t.Fatalf("ReadIndex returned error %q", err)
+	}
+	var indexed []string
+	for _, p := range index.Packages {
+		indexed = append(indexed, p.PackageVersion().String())
+	}
+	if want := []string{"app-1.0.0", "lib-1.0.0"}; !slices.Equal(indexed, want) {
+		t.Errorf("index: got %q, want %q", indexed, want)
+	}
+
+	prefix := filepath.Join(t.TempDir(), "root")
+	downloaderConfig := &downloader.Config{
+		Packages: []pkg.PackageVersionSpec{{Name: "app"}},
+		Prefix:   prefix,
+	}
+	downloader.FillDefaultVersionSpecs(downloaderConfig.Packages)
+	d, err := downloader.NewPackageDownloader(downloaderConfig, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Download(); err != nil {
+		t.Fatalf("Download returned error %q", err)
+	}
+	for name, want := range map[string]string{"lib/a.so": "a", "bin/app": "app"} {
+		if b, err := os.ReadFile(filepath.Join(prefix, name)); err != nil || string(b) != want {
+			t.Errorf("%q: got %q, %v, want %q", name, b, err, want)
+		}
+	}
+}
+
+// failingRepository fails uploads of the file.
+type failingRepository struct {
+	repository.Repository
+	file string
+}
+
+func (r *failingRepository) Put(name string, rd io.Reader) error {
+	if name == r.file {
+		return errors.New("connection reset")
+	}
+	return r.Repository.Put(name, rd)
+}
+
+func (r *failingRepository) Create(name string, rd io.Reader) error {
+	if name == r.file {
+		return errors.New("connection reset")
+	}
+	return r.Repository.Create(name, rd)
+}
+
+func TestUploadRetry(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "a"}, time.Now())
+	repo := repository.NewDir(filepath.Join(t.TempDir(), "repo"))
+
+	for _, file := range []string{"packet-1.0.0.meta.json", "packet-1.0.0"} {
+		err := upload(t, &failingRepository{Repository: repo, file: file}, testPackage(t, "packet", "1.0.0", src))
+		if err == nil || !strings.Contains(err.Error(), "connection reset") {
+			t.Fatalf("failing upload of %q: got error %v", file, err)
+		}
+		if _, err := repo.Stat("packet-1.0.0.sha256"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("failing upload of %q: checksum is left: %v", file, err)
+		}
+	}
+
+	if err := upload(t, repo, testPackage(t, "packet", "1.0.0", src)); err != nil {
+		t.Fatalf("retried Upload returned error %q", err)
+	}
+	if _, err := repository.DownloadPackageChecksum(repo, "packet-1.0.0"); err != nil {
+		t.Errorf("checksum of the uploaded package: %v", err)
+	}
+}
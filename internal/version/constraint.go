@@ -0,0 +1,108 @@
+package version
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type Comparison int
+
+const (
+	ComparisonEqual Comparison = iota + 1
+	ComparisonLess
+	ComparisonLessOrEqual
+	ComparisonGreater
+	ComparisonGreaterOrEqual
+)
+
+func (c Comparison) String() string {
+	switch c {
+	case ComparisonEqual:
+		return "="
+	case ComparisonLess:
+		return "<"
+	case ComparisonLessOrEqual:
+		return "<="
+	case ComparisonGreater:
+		return ">"
+	case ComparisonGreaterOrEqual:
+		return ">="
+	default:
+		panic(fmt.Sprintf("unknown comparison %d", c))
+	}
+}
+
+// Constraint is a single comparison against a version, e.g. ">=1.2".
+type Constraint struct {
+	Comparison Comparison
+	Version    Version
+}
+
+func (c Constraint) String() string {
+	return fmt.Sprintf("%s%s", c.Comparison, c.Version)
+}
+
+func (c *Constraint) Validate() error {
+	if c.Comparison < ComparisonEqual || c.Comparison > ComparisonGreaterOrEqual {
+		return fmt.Errorf("invalid comparison %d", c.Comparison)
+	}
+	if err := c.Version.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Constraint) Match(v Version) bool {
+	cmp := v.Compare(c.Version)
+	switch c.Comparison {
+	case ComparisonEqual:
+		return cmp == 0
+	case ComparisonLess:
+		return cmp < 0
+	case ComparisonLessOrEqual:
+		return cmp <= 0
+	case ComparisonGreater:
+		return cmp > 0
+	case ComparisonGreaterOrEqual:
+		return cmp >= 0
+	default:
+		panic(fmt.Sprintf("unknown comparison %d", c.Comparison))
+	}
+}
+
+var constraintRe = regexp.MustCompile(`^([><]=?|=)?(.+)$`)
+
+func ConstraintFromString(s string) (Constraint, error) {
+	var constraint Constraint
+	var err error
+
+	matches := constraintRe.FindStringSubmatch(s)
+	if len(matches) == 0 {
+		return constraint, fmt.Errorf("invalid constraint %q", s)
+	}
+
+	constraint.Comparison = ComparisonEqual
+	switch matches[1] {
+	case "=":
+		constraint.Comparison = ComparisonEqual
+	case "<":
+		constraint.Comparison = ComparisonLess
+	case "<=":
+		constraint.Comparison = ComparisonLessOrEqual
+	case ">":
+		constraint.Comparison = ComparisonGreater
+	case ">=":
+		constraint.Comparison = ComparisonGreaterOrEqual
+	}
+
+	constraint.Version, err = VersionFromString(matches[2])
+	if err != nil {
+		return constraint, err
+	}
+
+	if err := constraint.Validate(); err != nil {
+		return constraint, fmt.Errorf("invalid constraint %q: %s", s, err)
+	}
+
+	return constraint, nil
+}
@@ -4,43 +4,151 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Version is a semantic version (https://semver.org/spec/v2.0.0.html).
+// Two-part versions like "1.2" are accepted and treated as "1.2.0".
 type Version struct {
-	Major uint64
-	Minor uint64
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	PreRelease string // dot-separated identifiers without the leading "-"
+	Build      string // dot-separated identifiers without the leading "+"
 }
 
 func (v Version) String() string {
-	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.PreRelease != "" {
+		s += "-" + v.PreRelease
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
 }
 
 func (v *Version) Validate() error {
-	if v.Major == 0 && v.Minor == 0 {
-		return errors.New("invalid version 0.0")
+	if v.Major == 0 && v.Minor == 0 && v.Patch == 0 {
+		return fmt.Errorf("invalid version %s", v)
+	}
+	if v.PreRelease != "" {
+		if err := validateIdentifiers(v.PreRelease, true); err != nil {
+			return fmt.Errorf("invalid pre-release %q: %s", v.PreRelease, err)
+		}
+	}
+	if v.Build != "" {
+		if err := validateIdentifiers(v.Build, false); err != nil {
+			return fmt.Errorf("invalid build metadata %q: %s", v.Build, err)
+		}
+	}
+	return nil
+}
+
+var identifierRe = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+func validateIdentifiers(s string, isPreRelease bool) error {
+	for _, ident := range strings.Split(s, ".") {
+		if ident == "" {
+			return errors.New("empty identifier")
+		}
+		if !identifierRe.MatchString(ident) {
+			return fmt.Errorf("invalid identifier %q", ident)
+		}
+		if isPreRelease && isNumeric(ident) && len(ident) > 1 && ident[0] == '0' {
+			return fmt.Errorf("numeric identifier %q has leading zeros", ident)
+		}
 	}
 	return nil
 }
 
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Compare returns -1, 0 or 1 if v has lower, equal or higher precedence
+// than otherVersion. Build metadata is ignored.
+func (v Version) Compare(otherVersion Version) int {
+	switch {
+	case v.Major != otherVersion.Major:
+		return compareUint(v.Major, otherVersion.Major)
+	case v.Minor != otherVersion.Minor:
+		return compareUint(v.Minor, otherVersion.Minor)
+	case v.Patch != otherVersion.Patch:
+		return compareUint(v.Patch, otherVersion.Patch)
+	default:
+		return comparePreRelease(v.PreRelease, otherVersion.PreRelease)
+	}
+}
+
 func (v *Version) GreaterThan(otherVersion Version) bool {
+	return v.Compare(otherVersion) > 0
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// comparePreRelease compares pre-release strings as described in
+// section 11 of the SemVer specification: a version without pre-release
+// has higher precedence, otherwise identifiers are compared one by one.
+func comparePreRelease(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+
+	aIdents := strings.Split(a, ".")
+	bIdents := strings.Split(b, ".")
+	for i := 0; i < len(aIdents) && i < len(bIdents); i++ {
+		if c := compareIdentifier(aIdents[i], bIdents[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(aIdents)), uint64(len(bIdents)))
+}
+
+func compareIdentifier(a, b string) int {
+	aNumeric, bNumeric := isNumeric(a), isNumeric(b)
 	switch {
-	case v.Major > otherVersion.Major:
-		return true
-	case v.Major < otherVersion.Major:
-		return false
-	case v.Minor > otherVersion.Minor:
-		return true
-	case v.Minor < otherVersion.Minor:
-		return false
+	case aNumeric && bNumeric:
+		if len(a) != len(b) {
+			return compareUint(uint64(len(a)), uint64(len(b)))
+		}
+		return strings.Compare(a, b)
+	case aNumeric:
+		return -1
+	case bNumeric:
+		return 1
 	default:
-		return false
+		return strings.Compare(a, b)
 	}
 }
 
+func (v Version) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
 func (v *Version) UnmarshalJSON(b []byte) error {
 	var s string
 	if err := json.Unmarshal(b, &s); err != nil {
@@ -54,6 +162,10 @@ func (v *Version) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func (v Version) MarshalYAML() (any, error) {
+	return v.String(), nil
+}
+
 func (v *Version) UnmarshalYAML(node *yaml.Node) error {
 	version, err := VersionFromString(node.Value)
 	if err != nil {
@@ -63,23 +175,33 @@ func (v *Version) UnmarshalYAML(node *yaml.Node) error {
 	return nil
 }
 
+var versionRe = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.(\d+))?(?:-([^+]+))?(?:\+(.+))?$`)
+
 func VersionFromString(s string) (Version, error) {
 	var version Version
 	var err error
 
-	parts := strings.SplitN(s, ".", 2)
-	if len(parts) != 2 {
+	matches := versionRe.FindStringSubmatch(s)
+	if len(matches) == 0 {
 		return version, fmt.Errorf("invalid version %q", s)
 	}
 
-	version.Major, err = strconv.ParseUint(parts[0], 10, 64)
+	version.Major, err = strconv.ParseUint(matches[1], 10, 64)
 	if err != nil {
-		return version, fmt.Errorf("invalid major version %q", parts[0])
+		return version, fmt.Errorf("invalid major version %q", matches[1])
 	}
-	version.Minor, err = strconv.ParseUint(parts[1], 10, 64)
+	version.Minor, err = strconv.ParseUint(matches[2], 10, 64)
 	if err != nil {
-		return version, fmt.Errorf("invalid minor version %q", parts[1])
+		return version, fmt.Errorf("invalid minor version %q", matches[2])
+	}
+	if matches[3] != "" {
+		version.Patch, err = strconv.ParseUint(matches[3], 10, 64)
+		if err != nil {
+			return version, fmt.Errorf("invalid patch version %q", matches[3])
+		}
 	}
+	version.PreRelease = matches[4]
+	version.Build = matches[5]
 
 	if err := version.Validate(); err != nil {
 		return version, err
@@ -1,118 +1,84 @@
 package version
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
-type Comparison int
-
-const (
-	ComparisonEqual Comparison = iota + 1
-	ComparisonLess
-	ComparisonLessOrEqual
-	ComparisonGreater
-	ComparisonGreaterOrEqual
-)
-
-func (c Comparison) String() string {
-	switch c {
-	case ComparisonEqual:
-		return "="
-	case ComparisonLess:
-		return "<"
-	case ComparisonLessOrEqual:
-		return "<="
-	case ComparisonGreater:
-		return ">"
-	case ComparisonGreaterOrEqual:
-		return ">="
-	default:
-		panic(fmt.Sprintf("unknown comparison %d", c))
-	}
-}
-
-type VersionSpec struct {
-	Comparison Comparison
-	Version    Version
-}
+// VersionSpec is a list of alternatives separated by "||". Each
+// alternative is a list of constraints separated by spaces or commas, all
+// of which must match, e.g. ">=1.2 <2.0 || =3.1".
+type VersionSpec [][]Constraint
 
 func (vs VersionSpec) String() string {
-	return fmt.Sprintf("%s%s", vs.Comparison, vs.Version)
+	alternatives := make([]string, 0, len(vs))
+	for _, constraints := range vs {
+		strs := make([]string, 0, len(constraints))
+		for _, constraint := range constraints {
+			strs = append(strs, constraint.String())
+		}
+		if len(strs) == 0 {
+			// an alternative without constraints matches any version
+			strs = append(strs, "*")
+		}
+		alternatives = append(alternatives, strings.Join(strs, " "))
+	}
+	return strings.Join(alternatives, " || ")
 }
 
 func (vs *VersionSpec) Validate() error {
-	if vs.Comparison < ComparisonEqual || vs.Comparison > ComparisonGreaterOrEqual {
-		return fmt.Errorf("invalid comparison %d", vs.Comparison)
+	if len(*vs) == 0 {
+		return errors.New("empty version spec")
 	}
-	if err := vs.Version.Validate(); err != nil {
-		return err
+	for _, constraints := range *vs {
+		for _, constraint := range constraints {
+			if err := constraint.Validate(); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
 func (vs *VersionSpec) Match(v Version) bool {
-	switch vs.Comparison {
-	case ComparisonEqual:
-		return v.Major == vs.Version.Major && v.Minor == vs.Version.Minor
-	case ComparisonLess:
-		switch {
-		case v.Major < vs.Version.Major:
-			return true
-		case v.Major > vs.Version.Major:
-			return false
-		case v.Minor < vs.Version.Minor:
+	for _, constraints := range *vs {
+		if matchAll(constraints, v) {
 			return true
-		case v.Minor > vs.Version.Minor:
-			return false
-		default:
-			return false
-		}
-	case ComparisonLessOrEqual:
-		switch {
-		case v.Major < vs.Version.Major:
-			return true
-		case v.Major > vs.Version.Major:
-			return false
-		case v.Minor < vs.Version.Minor:
-			return true
-		case v.Minor > vs.Version.Minor:
-			return false
-		default:
-			return true
-		}
-	case ComparisonGreater:
-		switch {
-		case v.Major < vs.Version.Major:
-			return false
-		case v.Major > vs.Version.Major:
-			return true
-		case v.Minor < vs.Version.Minor:
-			return false
-		case v.Minor > vs.Version.Minor:
-			return true
-		default:
-			return false
 		}
-	case ComparisonGreaterOrEqual:
-		switch {
-		case v.Major < vs.Version.Major:
-			return false
-		case v.Major > vs.Version.Major:
-			return true
-		case v.Minor < vs.Version.Minor:
+	}
+	return false
+}
+
+func matchAll(constraints []Constraint, v Version) bool {
+	for _, constraint := range constraints {
+		if !constraint.Match(v) {
 			return false
-		case v.Minor > vs.Version.Minor:
-			return true
-		default:
-			return true
 		}
-	default:
-		panic(fmt.Sprintf("unknown comparison %d", vs.Comparison))
 	}
+	return true
+}
+
+func (vs VersionSpec) MarshalJSON() ([]byte, error) {
+	return marshalJSONString(vs.String())
+}
+
+// marshalJSONString is like json.Marshal, but does not escape "<" and ">",
+// which are common in version specs.
+func marshalJSONString(s string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
 }
 
 func (vs *VersionSpec) UnmarshalJSON(b []byte) error {
@@ -128,6 +94,10 @@ func (vs *VersionSpec) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func (vs VersionSpec) MarshalYAML() (any, error) {
+	return vs.String(), nil
+}
+
 func (vs *VersionSpec) UnmarshalYAML(node *yaml.Node) error {
 	var err error
 	*vs, err = VersionSpecFromString(node.Value)
@@ -137,39 +107,232 @@ func (vs *VersionSpec) UnmarshalYAML(node *yaml.Node) error {
 	return nil
 }
 
-var versionSpecRe = regexp.MustCompile(`^([><]=?|=)?(.+)$`)
+// SpecError points at the part of a version spec that failed to parse.
+type SpecError struct {
+	Spec string
+	Pos  int // byte offset of Part in Spec
+	Part string
+	Err  error
+}
+
+func (e *SpecError) Error() string {
+	if e.Part == "" {
+		return fmt.Sprintf("invalid version spec %q: %s", e.Spec, e.Err)
+	}
+	return fmt.Sprintf("invalid version spec %q: %s at column %d (%q)", e.Spec, e.Err, e.Pos+1, e.Part)
+}
+
+func (e *SpecError) Unwrap() error {
+	return e.Err
+}
 
+// VersionSpecFromString parses a version spec. Besides plain comparisons
+// it accepts shorthand operators which are desugared into ranges:
+//
+//	^1.4  ->  >=1.4.0 <2.0.0-0  (^0.4 -> >=0.4.0 <0.5.0-0)
+//	~1.4  ->  >=1.4.0 <1.5.0-0
+//	1.*   ->  >=1.0.0 <2.0.0-0  (also 1.x, 1.X and 1)
+//	*     ->  any version
+//
+// Upper bounds use the lowest pre-release ("-0") so that pre-releases of
+// the next version are excluded.
 func VersionSpecFromString(s string) (VersionSpec, error) {
 	var versionSpec VersionSpec
-	var err error
 
-	matches := versionSpecRe.FindStringSubmatch(s)
+	offset := 0
+	for _, alternative := range strings.Split(s, "||") {
+		constraints, err := constraintsFromString(s, alternative, offset)
+		if err != nil {
+			return nil, err
+		}
+		versionSpec = append(versionSpec, constraints)
+		offset += len(alternative) + len("||")
+	}
+
+	if err := versionSpec.Validate(); err != nil {
+		return nil, &SpecError{Spec: s, Err: err}
+	}
+
+	return versionSpec, nil
+}
+
+// constraintsFromString parses space or comma separated constraints of
+// alternative, which starts at offset in spec. The operator may be
+// separated from its version, as in ">= 1.2".
+func constraintsFromString(spec, alternative string, offset int) ([]Constraint, error) {
+	isSeparator := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == ','
+	}
+
+	var constraints []Constraint
+	found := false
+	i := 0
+	for i < len(alternative) {
+		if isSeparator(alternative[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(alternative) && strings.IndexByte("<>=^~", alternative[i]) >= 0 {
+			i++
+		}
+		op := alternative[start:i]
+		for op != "" && i < len(alternative) && isSeparator(alternative[i]) && alternative[i] != ',' {
+			i++
+		}
+		versionStart := i
+		for i < len(alternative) && !isSeparator(alternative[i]) {
+			i++
+		}
+		versionStr := alternative[versionStart:i]
+
+		desugared, err := desugar(op, versionStr)
+		if err != nil {
+			return nil, &SpecError{Spec: spec, Pos: offset + start, Part: alternative[start:i], Err: err}
+		}
+		constraints = append(constraints, desugared...)
+		found = true
+	}
+
+	if !found {
+		return nil, &SpecError{Spec: spec, Pos: offset, Part: alternative, Err: errors.New("empty alternative")}
+	}
+
+	return constraints, nil
+}
+
+func desugar(op, versionStr string) ([]Constraint, error) {
+	if versionStr == "" {
+		return nil, errors.New("missing version")
+	}
+
+	switch op {
+	case "^", "~":
+		partial, err := partialVersionFromString(versionStr)
+		if err != nil {
+			return nil, err
+		}
+		if partial.wildcard {
+			return nil, fmt.Errorf("wildcard is not allowed after %q", op)
+		}
+		if op == "^" {
+			return partial.caretRange(), nil
+		}
+		return partial.tildeRange(), nil
+	case "", "=":
+		partial, err := partialVersionFromString(versionStr)
+		if err != nil {
+			return nil, err
+		}
+		if partial.wildcard || partial.parts < 2 {
+			return partial.wildcardRange(), nil
+		}
+		return []Constraint{{Comparison: ComparisonEqual, Version: partial.Version}}, nil
+	default:
+		constraint, err := ConstraintFromString(op + versionStr)
+		if err != nil {
+			return nil, err
+		}
+		return []Constraint{constraint}, nil
+	}
+}
+
+// partialVersion is a version where trailing parts may be missing or
+// replaced with a wildcard ("*", "x" or "X").
+type partialVersion struct {
+	Version
+	parts    int // number of numeric parts present
+	wildcard bool
+}
+
+var partialVersionRe = regexp.MustCompile(`^(\d+|[*xX])(?:\.(\d+|[*xX]))?(?:\.(\d+|[*xX]))?(?:-([^+]+))?(?:\+(.+))?$`)
+
+func partialVersionFromString(s string) (partialVersion, error) {
+	var partial partialVersion
+
+	matches := partialVersionRe.FindStringSubmatch(s)
 	if len(matches) == 0 {
-		return versionSpec, fmt.Errorf("invalid version spec %q", s)
+		return partial, fmt.Errorf("invalid version %q", s)
 	}
 
-	versionSpec.Comparison = ComparisonEqual
-	switch matches[1] {
-	case "=":
-		versionSpec.Comparison = ComparisonEqual
-	case "<":
-		versionSpec.Comparison = ComparisonLess
-	case "<=":
-		versionSpec.Comparison = ComparisonLessOrEqual
-	case ">":
-		versionSpec.Comparison = ComparisonGreater
-	case ">=":
-		versionSpec.Comparison = ComparisonGreaterOrEqual
+	nums := make([]uint64, 0, 3)
+	for _, part := range matches[1:4] {
+		if part == "" {
+			break
+		}
+		if part == "*" || part == "x" || part == "X" {
+			partial.wildcard = true
+			continue
+		}
+		if partial.wildcard {
+			return partial, fmt.Errorf("invalid version %q: number after wildcard", s)
+		}
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return partial, fmt.Errorf("invalid version %q", s)
+		}
+		nums = append(nums, n)
+	}
+	if (partial.wildcard || len(nums) < 2) && (matches[4] != "" || matches[5] != "") {
+		return partial, fmt.Errorf("invalid version %q: pre-release and build metadata need a full version", s)
 	}
 
-	versionSpec.Version, err = VersionFromString(matches[2])
-	if err != nil {
-		return versionSpec, err
+	partial.parts = len(nums)
+	nums = append(nums, 0, 0, 0)
+	partial.Major, partial.Minor, partial.Patch = nums[0], nums[1], nums[2]
+	partial.PreRelease = matches[4]
+	partial.Build = matches[5]
+
+	if partial.PreRelease != "" || partial.Build != "" {
+		if err := partial.Version.Validate(); err != nil {
+			return partial, err
+		}
 	}
 
-	if err := versionSpec.Validate(); err != nil {
-		return versionSpec, fmt.Errorf("invalid version spec %q: %s", s, err)
+	return partial, nil
+}
+
+// caretRange allows changes that do not modify the left-most non-zero part.
+func (p partialVersion) caretRange() []Constraint {
+	switch {
+	case p.Major > 0 || p.parts == 1:
+		return p.rangeTo(Version{Major: p.Major + 1})
+	case p.Minor > 0 || p.parts == 2:
+		return p.rangeTo(Version{Minor: p.Minor + 1})
+	default:
+		return p.rangeTo(Version{Patch: p.Patch + 1})
 	}
+}
 
-	return versionSpec, nil
+// tildeRange allows patch level changes, or minor level changes if only
+// the major version is given.
+func (p partialVersion) tildeRange() []Constraint {
+	if p.parts == 1 {
+		return p.rangeTo(Version{Major: p.Major + 1})
+	}
+	return p.rangeTo(Version{Major: p.Major, Minor: p.Minor + 1})
+}
+
+func (p partialVersion) wildcardRange() []Constraint {
+	switch p.parts {
+	case 0:
+		return []Constraint{}
+	case 1:
+		return p.rangeTo(Version{Major: p.Major + 1})
+	default:
+		return p.rangeTo(Version{Major: p.Major, Minor: p.Minor + 1})
+	}
+}
+
+// rangeTo returns constraints for [p, upper). A zero lower bound matches
+// every version and is omitted.
+func (p partialVersion) rangeTo(upper Version) []Constraint {
+	var constraints []Constraint
+	if p.Version != (Version{}) {
+		constraints = append(constraints, Constraint{Comparison: ComparisonGreaterOrEqual, Version: p.Version})
+	}
+	upper.PreRelease = "0"
+	constraints = append(constraints, Constraint{Comparison: ComparisonLess, Version: upper})
+	return constraints
 }
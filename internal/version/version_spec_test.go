@@ -1,6 +1,8 @@
 package version
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -15,12 +17,45 @@ func TestVersionSpecFromString(t *testing.T) {
 		{str: ">>1.2", wantErr: true},
 		{str: "?1.2", wantErr: true},
 		{str: "x1.2", wantErr: true},
-		{str: "1.2", wantVersionSpec: VersionSpec{Comparison: ComparisonEqual, Version: Version{Major: 1, Minor: 2}}},
-		{str: "=1.2", wantVersionSpec: VersionSpec{Comparison: ComparisonEqual, Version: Version{Major: 1, Minor: 2}}},
-		{str: "<1.2", wantVersionSpec: VersionSpec{Comparison: ComparisonLess, Version: Version{Major: 1, Minor: 2}}},
-		{str: "<=1.2", wantVersionSpec: VersionSpec{Comparison: ComparisonLessOrEqual, Version: Version{Major: 1, Minor: 2}}},
-		{str: ">1.2", wantVersionSpec: VersionSpec{Comparison: ComparisonGreater, Version: Version{Major: 1, Minor: 2}}},
-		{str: ">=1.2", wantVersionSpec: VersionSpec{Comparison: ComparisonGreaterOrEqual, Version: Version{Major: 1, Minor: 2}}},
+		{str: "1.2", wantVersionSpec: VersionSpec{{{Comparison: ComparisonEqual, Version: Version{Major: 1, Minor: 2}}}}},
+		{str: "=1.2", wantVersionSpec: VersionSpec{{{Comparison: ComparisonEqual, Version: Version{Major: 1, Minor: 2}}}}},
+		{str: "<1.2", wantVersionSpec: VersionSpec{{{Comparison: ComparisonLess, Version: Version{Major: 1, Minor: 2}}}}},
+		{str: "<=1.2", wantVersionSpec: VersionSpec{{{Comparison: ComparisonLessOrEqual, Version: Version{Major: 1, Minor: 2}}}}},
+		{str: ">1.2", wantVersionSpec: VersionSpec{{{Comparison: ComparisonGreater, Version: Version{Major: 1, Minor: 2}}}}},
+		{str: ">=1.2", wantVersionSpec: VersionSpec{{{Comparison: ComparisonGreaterOrEqual, Version: Version{Major: 1, Minor: 2}}}}},
+		{str: ">=1.2.3-rc.1", wantVersionSpec: VersionSpec{{{Comparison: ComparisonGreaterOrEqual, Version: Version{Major: 1, Minor: 2, Patch: 3, PreRelease: "rc.1"}}}}},
+		{str: "", wantErr: true},
+		{str: "||", wantErr: true},
+		{str: ">=1.2 ||", wantErr: true},
+		{str: ">=1.2 | <2.0", wantErr: true},
+		{str: ">=1.2 <", wantErr: true},
+		{str: ">=1.2 <2.0 y", wantErr: true},
+		{
+			str: ">=1.2 <2.0",
+			wantVersionSpec: VersionSpec{{
+				{Comparison: ComparisonGreaterOrEqual, Version: Version{Major: 1, Minor: 2}},
+				{Comparison: ComparisonLess, Version: Version{Major: 2}},
+			}},
+		},
+		{
+			str: " >= 1.2, < 2.0 ",
+			wantVersionSpec: VersionSpec{{
+				{Comparison: ComparisonGreaterOrEqual, Version: Version{Major: 1, Minor: 2}},
+				{Comparison: ComparisonLess, Version: Version{Major: 2}},
+			}},
+		},
+		{
+			str: ">=1.2 <2.0 || =3.1",
+			wantVersionSpec: VersionSpec{
+				{
+					{Comparison: ComparisonGreaterOrEqual, Version: Version{Major: 1, Minor: 2}},
+					{Comparison: ComparisonLess, Version: Version{Major: 2}},
+				},
+				{
+					{Comparison: ComparisonEqual, Version: Version{Major: 3, Minor: 1}},
+				},
+			},
+		},
 	}
 	for ti, tt := range tests {
 		versionSpec, err := VersionSpecFromString(tt.str)
@@ -32,7 +67,7 @@ func TestVersionSpecFromString(t *testing.T) {
 			t.Errorf("failed test #%d: expected error from VersionSpecFromString(%q)", ti, tt.str)
 			continue
 		}
-		if !tt.wantErr && versionSpec != tt.wantVersionSpec {
+		if !tt.wantErr && !reflect.DeepEqual(versionSpec, tt.wantVersionSpec) {
 			t.Errorf("failed test #%d: VersionSpecFromString(%q): got %#v, want %#v", ti, tt.str, versionSpec, tt.wantVersionSpec)
 		}
 	}
@@ -73,6 +108,36 @@ func TestVersionSpecMatch(t *testing.T) {
 		{versionStr: "1.1", versionSpecStr: ">1.2", wantMatch: false},
 		{versionStr: "1.1", versionSpecStr: "<1.2", wantMatch: true},
 		{versionStr: "1.1", versionSpecStr: "<=1.2", wantMatch: true},
+
+		{versionStr: "1.1.0", versionSpecStr: "1.1", wantMatch: true},
+		{versionStr: "1.1.1", versionSpecStr: "1.1", wantMatch: false},
+		{versionStr: "1.1.1", versionSpecStr: ">1.1", wantMatch: true},
+		{versionStr: "1.1.1", versionSpecStr: "<1.1.2", wantMatch: true},
+		{versionStr: "1.1.0+build.1", versionSpecStr: "1.1.0+build.2", wantMatch: true},
+
+		{versionStr: "2.0.0-rc.1", versionSpecStr: "<2.0", wantMatch: true},
+		{versionStr: "2.0.0-rc.1", versionSpecStr: ">=2.0", wantMatch: false},
+		{versionStr: "2.0.0-rc.2", versionSpecStr: ">2.0.0-rc.1", wantMatch: true},
+		{versionStr: "2.0.0-rc.1", versionSpecStr: ">2.0.0-beta", wantMatch: true},
+
+		{versionStr: "1.1", versionSpecStr: ">=1.2 <2.0", wantMatch: false},
+		{versionStr: "1.2", versionSpecStr: ">=1.2 <2.0", wantMatch: true},
+		{versionStr: "1.9.9", versionSpecStr: ">=1.2,<2.0", wantMatch: true},
+		{versionStr: "2.0", versionSpecStr: ">=1.2 <2.0", wantMatch: false},
+		{versionStr: "3.1", versionSpecStr: ">=1.2 <2.0 || =3.1", wantMatch: true},
+		{versionStr: "3.0", versionSpecStr: ">=1.2 <2.0 || =3.1", wantMatch: false},
+		{versionStr: "1.5", versionSpecStr: ">=1.2 <2.0 || =3.1", wantMatch: true},
+
+		{versionStr: "1.9.9", versionSpecStr: "^1.4", wantMatch: true},
+		{versionStr: "2.0.0-rc.1", versionSpecStr: "^1.4", wantMatch: false},
+		{versionStr: "1.3.9", versionSpecStr: "^1.4", wantMatch: false},
+		{versionStr: "0.4.7", versionSpecStr: "^0.4", wantMatch: true},
+		{versionStr: "0.5.0", versionSpecStr: "^0.4", wantMatch: false},
+		{versionStr: "1.4.9", versionSpecStr: "~1.4", wantMatch: true},
+		{versionStr: "1.5.0", versionSpecStr: "~1.4", wantMatch: false},
+		{versionStr: "1.0.0", versionSpecStr: "1.x", wantMatch: true},
+		{versionStr: "2.0.0", versionSpecStr: "1.*", wantMatch: false},
+		{versionStr: "0.0.1", versionSpecStr: "*", wantMatch: true},
 	}
 
 	for ti, tt := range tests {
@@ -94,3 +159,68 @@ func TestVersionSpecMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestVersionSpecDesugar(t *testing.T) {
+	tests := []struct {
+		str  string
+		want string
+	}{
+		{str: "^1.4", want: ">=1.4.0 <2.0.0-0"},
+		{str: "^1.4.2", want: ">=1.4.2 <2.0.0-0"},
+		{str: "^1", want: ">=1.0.0 <2.0.0-0"},
+		{str: "^0.4", want: ">=0.4.0 <0.5.0-0"},
+		{str: "^0.0.3", want: ">=0.0.3 <0.0.4-0"},
+		{str: "^0.0", want: "<0.1.0-0"},
+		{str: "^1.2.3-rc.1", want: ">=1.2.3-rc.1 <2.0.0-0"},
+		{str: "~1.4", want: ">=1.4.0 <1.5.0-0"},
+		{str: "~1.4.2", want: ">=1.4.2 <1.5.0-0"},
+		{str: "~1", want: ">=1.0.0 <2.0.0-0"},
+		{str: "~0.4", want: ">=0.4.0 <0.5.0-0"},
+		{str: "1.*", want: ">=1.0.0 <2.0.0-0"},
+		{str: "1.x", want: ">=1.0.0 <2.0.0-0"},
+		{str: "1.X.X", want: ">=1.0.0 <2.0.0-0"},
+		{str: "1", want: ">=1.0.0 <2.0.0-0"},
+		{str: "=1.4.*", want: ">=1.4.0 <1.5.0-0"},
+		{str: "0.x", want: "<1.0.0-0"},
+		{str: "*", want: "*"},
+		{str: "^1.4 || ~2.1, >=2.1.3", want: ">=1.4.0 <2.0.0-0 || >=2.1.0 <2.2.0-0 >=2.1.3"},
+	}
+
+	for ti, tt := range tests {
+		versionSpec, err := VersionSpecFromString(tt.str)
+		if err != nil {
+			t.Errorf("failed test #%d: VersionSpecFromString(%q) returned error %q", ti, tt.str, err)
+			continue
+		}
+		if got := versionSpec.String(); got != tt.want {
+			t.Errorf("failed test #%d: VersionSpecFromString(%q): got %q, want %q", ti, tt.str, got, tt.want)
+		}
+	}
+}
+
+func TestVersionSpecFromStringErrorPosition(t *testing.T) {
+	tests := []struct {
+		str      string
+		wantPos  int
+		wantPart string
+	}{
+		{str: "x.1", wantPos: 0, wantPart: "x.1"},
+		{str: ">=1.2 <x.1", wantPos: 6, wantPart: "<x.1"},
+		{str: ">=1.2 || ^1.*", wantPos: 9, wantPart: "^1.*"},
+		{str: ">=1.2 ||  || 3.0", wantPos: 8, wantPart: "  "},
+		{str: "1.0, ~", wantPos: 5, wantPart: "~"},
+		{str: ">= 1.2, 1.*.3", wantPos: 8, wantPart: "1.*.3"},
+	}
+
+	for ti, tt := range tests {
+		_, err := VersionSpecFromString(tt.str)
+		var specErr *SpecError
+		if !errors.As(err, &specErr) {
+			t.Errorf("failed test #%d: VersionSpecFromString(%q): expected SpecError, got %v", ti, tt.str, err)
+			continue
+		}
+		if specErr.Pos != tt.wantPos || specErr.Part != tt.wantPart {
+			t.Errorf("failed test #%d: VersionSpecFromString(%q): got error at %d (%q), want at %d (%q)", ti, tt.str, specErr.Pos, specErr.Part, tt.wantPos, tt.wantPart)
+		}
+	}
+}
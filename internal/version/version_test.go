@@ -17,6 +17,19 @@ func TestVersionFromString(t *testing.T) {
 		{str: "0.1", wantVersion: Version{Major: 0, Minor: 1}},
 		{str: "001.0001", wantVersion: Version{Major: 1, Minor: 1}},
 		{str: "1000.1000", wantVersion: Version{Major: 1000, Minor: 1000}},
+		{str: "0.0.0", wantErr: true},
+		{str: "1.2.3.4", wantErr: true},
+		{str: "1.2.3-", wantErr: true},
+		{str: "1.2.3+", wantErr: true},
+		{str: "1.2.3-rc..1", wantErr: true},
+		{str: "1.2.3-rc.01", wantErr: true},
+		{str: "1.2.3-rc_1", wantErr: true},
+		{str: "0.0.1", wantVersion: Version{Patch: 1}},
+		{str: "1.4.2", wantVersion: Version{Major: 1, Minor: 4, Patch: 2}},
+		{str: "1.2-rc.1", wantVersion: Version{Major: 1, Minor: 2, PreRelease: "rc.1"}},
+		{str: "2.0.0-rc.1+build.7", wantVersion: Version{Major: 2, PreRelease: "rc.1", Build: "build.7"}},
+		{str: "2.0.0+build-01", wantVersion: Version{Major: 2, Build: "build-01"}},
+		{str: "1.0.0-x-y-z.--", wantVersion: Version{Major: 1, PreRelease: "x-y-z.--"}},
 	}
 
 	for ti, tt := range tests {
@@ -34,3 +47,45 @@ func TestVersionFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestVersionCompare(t *testing.T) {
+	// ordered by precedence, see https://semver.org/spec/v2.0.0.html#spec-item-11
+	ordered := []string{
+		"0.1",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.2",
+		"1.10.0",
+		"2.0.0",
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			v1, err := VersionFromString(ordered[i])
+			if err != nil {
+				t.Fatalf("VersionFromString(%q) returned error %q", ordered[i], err)
+			}
+			v2, err := VersionFromString(ordered[j])
+			if err != nil {
+				t.Fatalf("VersionFromString(%q) returned error %q", ordered[j], err)
+			}
+			want := compareUint(uint64(i), uint64(j))
+			if got := v1.Compare(v2); got != want {
+				t.Errorf("%q compare %q: got %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	v1 := Version{Major: 1, Build: "a"}
+	v2 := Version{Major: 1, Build: "b"}
+	if c := v1.Compare(v2); c != 0 {
+		t.Errorf("build metadata must be ignored, got %d", c)
+	}
+}